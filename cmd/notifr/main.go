@@ -8,10 +8,15 @@ LICENSE file in the root directory of this source tree.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/mail"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/i-core/notifr/internal/notifr"
 	"github.com/i-core/notifr/internal/stat"
@@ -24,11 +29,29 @@ import (
 // version will be filled at compile time.
 var version = ""
 
+// shutdownTimeout is a time to finish requests in progress after a signal to stop.
+const shutdownTimeout = 30 * time.Second
+
 type config struct {
-	DevMode bool                 `envconfig:"dev_mode" default:"false" desc:"a development mode"`
-	Listen  string               `envconfig:"listen" default:":8080" desc:"a host and port to listen on (<host>:<port>)"`
-	Targets notifr.TargetsConfig `envconfig:"targets" required:"true" desc:"configuration for routing messages by target name (<target>:<delivery>:<recipient>)"`
-	SMTP    notifr.SMTPConfig
+	DevMode    bool                 `envconfig:"dev_mode" default:"false" desc:"a development mode"`
+	Listen     string               `envconfig:"listen" default:":8080" desc:"a host and port to listen on (<host>:<port>)"`
+	Targets    notifr.TargetsConfig `envconfig:"targets" required:"true" desc:"configuration for routing messages by target name (<target>:<delivery>:<recipient>)"`
+	Limits     notifr.LimitsConfig  `envconfig:"limits"`
+	Async      notifr.AsyncConfig   `envconfig:"async"`
+	SMTP       notifr.SMTPConfig
+	Slack      notifr.SlackConfig
+	Telegram   notifr.TelegramConfig
+	Webhook    notifr.WebhookConfig
+	Teams      notifr.TeamsConfig
+	Mattermost notifr.MattermostConfig
+	RocketChat notifr.RocketChatConfig
+	Discord    notifr.DiscordConfig
+	Matrix     notifr.MatrixConfig
+	SMS        notifr.SMSConfig
+	Ntfy       notifr.NtfyConfig
+	Gotify     notifr.GotifyConfig
+	Pushover   notifr.PushoverConfig
+	Syslog     notifr.SyslogConfig
 }
 
 func main() {
@@ -63,20 +86,121 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cnf.SMTP.Host == "" && !cnf.SMTP.MX {
+		fmt.Fprintln(os.Stderr, "Invalid configuration: an SMTP host is not specified")
+		os.Exit(1)
+	}
+	if cnf.SMTP.MX {
+		// MX servers reject emails without a valid sender, and the sender's domain is a fallback EHLO name.
+		if _, err := mail.ParseAddress(cnf.SMTP.From); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: an SMTP sender address is required in the MX mode: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	templates := []string{cnf.SMTP.Template}
+	for _, name := range cnf.SMTP.TargetTemplates {
+		templates = append(templates, name)
+	}
+	for _, name := range templates {
+		if !cnf.SMTP.Templates.Has(name) {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: unknown email template %q\n", name)
+			os.Exit(1)
+		}
+	}
+
+	smtpSender := notifr.NewSMTPSender(cnf.SMTP)
 	senders := map[notifr.DeliveryType]notifr.Sender{
-		notifr.DeliverySMTP: notifr.NewSMTPSender(cnf.SMTP),
+		notifr.DeliverySMTP:       smtpSender,
+		notifr.DeliverySlack:      notifr.NewSlackSender(cnf.Slack),
+		notifr.DeliveryTeams:      notifr.NewTeamsSender(cnf.Teams),
+		notifr.DeliveryMattermost: notifr.NewMattermostSender(cnf.Mattermost),
+		notifr.DeliveryRocketChat: notifr.NewRocketChatSender(cnf.RocketChat),
+		notifr.DeliveryDiscord:    notifr.NewDiscordSender(cnf.Discord),
+		notifr.DeliveryNtfy:       notifr.NewNtfySender(cnf.Ntfy),
+		notifr.DeliverySyslog:     notifr.NewSyslogSender(cnf.Syslog),
+	}
+	if cnf.Telegram.Token != "" {
+		senders[notifr.DeliveryTelegram] = notifr.NewTelegramSender(cnf.Telegram)
+	}
+	if cnf.Matrix.AccessToken != "" {
+		if cnf.Matrix.Homeserver == "" {
+			fmt.Fprintln(os.Stderr, "Invalid configuration: a Matrix homeserver is not specified")
+			os.Exit(1)
+		}
+		senders[notifr.DeliveryMatrix] = notifr.NewMatrixSender(cnf.Matrix)
+	}
+	if cnf.SMS.GatewayURL != "" {
+		senders[notifr.DeliverySMS] = notifr.NewSMSSender(cnf.SMS)
+	}
+	if cnf.Gotify.ServerURL != "" {
+		senders[notifr.DeliveryGotify] = notifr.NewGotifySender(cnf.Gotify)
+	}
+	if cnf.Pushover.Token != "" {
+		senders[notifr.DeliveryPushover] = notifr.NewPushoverSender(cnf.Pushover)
+	}
+	if !cnf.Webhook.Endpoints.Empty() {
+		senders[notifr.DeliveryWebhook] = notifr.NewWebhookSender(cnf.Webhook)
 	}
 
 	router := routegroup.NewRouter(rlog.NewMiddleware(log))
-	handler, err := notifr.NewHandler(cnf.Targets, senders)
+	handler, err := notifr.NewHandler(cnf.Targets, senders, cnf.Limits, cnf.Async)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create the notification handler: %s\n", err)
 		os.Exit(1)
 	}
+	handler.Resume(log.Named("queue"))
 	router.AddRoutes(handler, "/notifr")
 	router.AddRoutes(stat.NewHandler(version), "/stat")
+	// The mailbox is checked until notifr stops; a check in progress is finished to save the state of bounces.
+	bouncesCtx, stopBounces := context.WithCancel(context.Background())
+	bouncesDone := make(chan struct{})
+	if cnf.SMTP.Bounce.Host != "" {
+		if err = smtpSender.Bounces().Restore(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to restore bounces: %s\n", err)
+			os.Exit(1)
+		}
+		// DELETE /notifr/bounces enables bouncing recipients again and, like the rest of the API, it is not authenticated,
+		// so notifr must be reachable only by trusted clients.
+		router.AddRoutes(smtpSender.Bounces(), "/notifr/bounces")
+		go func() {
+			smtpSender.Bounces().Run(bouncesCtx, log.Named("bounces"))
+			close(bouncesDone)
+		}()
+	} else {
+		close(bouncesDone)
+	}
 
 	log = log.Named("main")
 	log.Info("notifr started", zap.Any("config", cnf), zap.String("version", version))
-	log.Fatal("notifr finished", zap.Error(http.ListenAndServe(cnf.Listen, router)))
+
+	srv := &http.Server{Addr: cnf.Listen, Handler: router}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errc:
+		smtpSender.Close()
+		log.Fatal("notifr finished", zap.Error(err))
+	case s := <-sig:
+		log.Info("Shutting down", zap.Stringer("signal", s))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		log.Info("Failed to finish requests in progress", zap.Error(err))
+	}
+	// Queued messages are delivered before connections to an SMTP relay are closed.
+	if err = handler.Close(ctx); err != nil {
+		log.Info("Failed to deliver queued messages", zap.Error(err))
+	}
+	stopBounces()
+	select {
+	case <-bouncesDone:
+	case <-ctx.Done():
+		log.Info("Failed to finish the check of bounces in progress", zap.Error(ctx.Err()))
+	}
+	// Idle connections to an SMTP relay are closed with QUIT, so the relay does not wait for them to time out.
+	smtpSender.Close()
+	log.Info("notifr finished")
 }
@@ -1,16 +1,29 @@
 module github.com/i-core/notifr
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/domodwyer/mailyak v3.1.1+incompatible
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/domodwyer/mailyak/v3 v3.6.2
 	github.com/grokify/html-strip-tags-go v0.0.0-20190424092004-025bd760b278
 	github.com/i-core/rlog v1.0.0
 	github.com/i-core/routegroup v1.0.0
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/pkg/errors v0.8.1
 	github.com/russross/blackfriday/v2 v2.0.1
-	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	go.mozilla.org/pkcs7 v0.9.0
 	go.uber.org/zap v1.10.0
+	golang.org/x/net v0.11.0
+)
+
+require (
+	github.com/cloudflare/circl v1.3.7 // indirect
+	github.com/gofrs/uuid v3.2.0+incompatible // indirect
+	github.com/julienschmidt/httprouter v1.2.0 // indirect
+	github.com/justinas/alice v0.0.0-20171023064455-03f45bd4b7da // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	go.uber.org/atomic v1.4.0 // indirect
+	go.uber.org/multierr v1.1.0 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
 )
 
-go 1.13
+go 1.17
@@ -0,0 +1,272 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// AsyncConfig is a configuration of asynchronous delivery of messages.
+type AsyncConfig struct {
+	Enabled   bool   `envconfig:"enabled" default:"false" desc:"respond 202 Accepted without waiting for delivery, and deliver messages in background workers"`
+	Workers   int    `envconfig:"workers" default:"4" desc:"a number of background workers that deliver messages"`
+	QueueSize int    `envconfig:"queue_size" default:"1000" desc:"a maximum number of messages waiting for delivery; new messages are rejected when the queue is full"`
+	QueueDir  string `envconfig:"queue_dir" desc:"a path to a directory where accepted messages are stored until they are delivered; messages are kept in memory only when it is empty"`
+}
+
+// queuedMessage is a message that waits for delivery in background.
+// It is stored in the queue's directory as JSON, so it is delivered after a restart.
+type queuedMessage struct {
+	ID       string    `json:"id"`
+	Target   string    `json:"target"`
+	Message  Message   `json:"message"`
+	Accepted time.Time `json:"accepted"`
+	// Done are the deliveries that have finished, successfully or not. They are skipped after a restart.
+	Done []DeliveryType `json:"done,omitempty"`
+	// Sent are the recipients that deliveries have sent the message to one by one, by delivery.
+	// They are skipped when an unfinished delivery is resumed after a restart.
+	Sent map[DeliveryType][]string `json:"sent,omitempty"`
+	// log is the logger of the request that accepted the message.
+	log *zap.SugaredLogger
+}
+
+// isDone returns true if a delivery of a message has finished.
+func (m *queuedMessage) isDone(name DeliveryType) bool {
+	for _, v := range m.Done {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingRecipients returns the recipients of a delivery that the message has not been sent to.
+func (m *queuedMessage) pendingRecipients(dlv *delivery) []string {
+	sent := make(map[string]bool, len(m.Sent[dlv.name]))
+	for _, rcpt := range m.Sent[dlv.name] {
+		sent[rcpt] = true
+	}
+	var rcpts []string
+	for _, rcpt := range dlv.recipients {
+		if !sent[rcpt] {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	return rcpts
+}
+
+// messageQueue is a queue of messages that are delivered by background workers.
+type messageQueue struct {
+	targets TargetsConfig
+	senders map[DeliveryType]Sender
+	ch      chan *queuedMessage
+	// store keeps messages until they are delivered. It is nil if messages are kept in memory only.
+	store *messageStore
+	// mu serializes updates of stored messages, because deliveries of a message finish concurrently.
+	mu sync.Mutex
+
+	// closeMu guards closed, so that no message is added to ch after it is closed.
+	closeMu sync.RWMutex
+	closed  bool
+	// stop is closed when the queue stops accepting messages, to stop resuming stored messages.
+	stop     chan struct{}
+	resuming sync.WaitGroup
+	workers  sync.WaitGroup
+}
+
+// errQueueClosed is returned when a message is pushed to a queue that is closed.
+var errQueueClosed = errors.New("queue is closed")
+
+// newMessageQueue returns a new queue and starts its workers.
+func newMessageQueue(cnf AsyncConfig, targets TargetsConfig, senders map[DeliveryType]Sender) (*messageQueue, error) {
+	if cnf.Workers <= 0 {
+		return nil, errors.New("a number of workers must be positive")
+	}
+	if cnf.QueueSize < 0 {
+		return nil, errors.New("a queue size must not be negative")
+	}
+	q := &messageQueue{targets: targets, senders: senders, ch: make(chan *queuedMessage, cnf.QueueSize), stop: make(chan struct{})}
+	if cnf.QueueDir != "" {
+		store, err := openMessageStore(cnf.QueueDir)
+		if err != nil {
+			return nil, err
+		}
+		q.store = store
+	}
+	for i := 0; i < cnf.Workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q, nil
+}
+
+// push stores a message and adds it to the queue. The method returns false if the queue is full,
+// and errQueueClosed if the queue is closed.
+func (q *messageQueue) push(m *queuedMessage) (bool, error) {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+	if q.closed {
+		return false, errQueueClosed
+	}
+	if q.store != nil {
+		if err := q.store.save(m); err != nil {
+			return false, err
+		}
+	}
+	select {
+	case q.ch <- m:
+		return true, nil
+	default:
+		if q.store != nil {
+			if err := q.store.remove(m.ID); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+}
+
+// resume adds the messages that were stored before a restart to the queue.
+// The messages are added in background in the order of their acceptance, and they can exceed the queue's size.
+// Stored files that cannot be read are renamed and logged.
+func (q *messageQueue) resume(log *zap.Logger) {
+	if q.store == nil {
+		return
+	}
+	msgs, errs := q.store.load()
+	for _, err := range errs {
+		log.Info("Failed to load queued message", zap.Error(err))
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	log.Info("Resuming delivery of queued messages", zap.Int("count", len(msgs)))
+	q.resuming.Add(1)
+	go func() {
+		defer q.resuming.Done()
+		for _, m := range msgs {
+			m.log = log.Sugar()
+			select {
+			case q.ch <- m:
+			case <-q.stop:
+				// The rest of the messages stay in the store until the next start.
+				return
+			}
+		}
+	}()
+}
+
+// close stops accepting messages and waits until the workers deliver the queued messages or the context is done.
+// Messages that are not delivered in time stay in the store if it is enabled, and they are lost otherwise.
+func (q *messageQueue) close(ctx context.Context) error {
+	q.closeMu.Lock()
+	if q.closed {
+		q.closeMu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.closeMu.Unlock()
+
+	close(q.stop)
+	q.resuming.Wait()
+	close(q.ch)
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "%d queued messages are not delivered", len(q.ch))
+	}
+}
+
+func (q *messageQueue) work() {
+	defer q.workers.Done()
+	for m := range q.ch {
+		q.deliver(m)
+	}
+}
+
+// deliver sends a message to the deliveries that have not finished yet, and removes the message from the store.
+func (q *messageQueue) deliver(m *queuedMessage) {
+	log := m.log.With("id", m.ID)
+	target, ok := q.targets.targets[m.Target]
+	if !ok {
+		// A target can be removed from the configuration before a restart.
+		log.Infow("Failed to send message of unknown target", "target", m.Target)
+	} else {
+		var pending []*delivery
+		for _, dlv := range target.deliveries {
+			if m.isDone(dlv.name) {
+				continue
+			}
+			// A delivery that was interrupted after it had sent the message to all recipients has nothing to resume.
+			if rcpts := m.pendingRecipients(dlv); len(rcpts) != 0 {
+				pending = append(pending, &delivery{name: dlv.name, recipients: rcpts})
+			}
+		}
+		msg := m.Message
+		msg.Target = m.Target
+		deliverMessage(log, pending, q.senders, msg,
+			func(dlv *delivery) { q.markDone(log, m, dlv.name) },
+			func(dlv *delivery, rcpt string) { q.markSent(log, m, dlv.name, rcpt) })
+	}
+	if q.store != nil {
+		if err := q.store.remove(m.ID); err != nil {
+			log.Infow("Failed to remove queued message", zap.Error(err))
+		}
+	}
+}
+
+// markDone records that a delivery of a message has finished.
+func (q *messageQueue) markDone(log *zap.SugaredLogger, m *queuedMessage, name DeliveryType) {
+	if q.store == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m.Done = append(m.Done, name)
+	if err := q.store.save(m); err != nil {
+		log.Infow("Failed to update queued message", "delivery", name, zap.Error(err))
+	}
+}
+
+// markSent records that a delivery has sent a message to a recipient.
+func (q *messageQueue) markSent(log *zap.SugaredLogger, m *queuedMessage, name DeliveryType, rcpt string) {
+	if q.store == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if m.Sent == nil {
+		m.Sent = make(map[DeliveryType][]string)
+	}
+	m.Sent[name] = append(m.Sent[name], rcpt)
+	if err := q.store.save(m); err != nil {
+		log.Infow("Failed to update queued message", "delivery", name, zap.Error(err))
+	}
+}
+
+// newQueueID returns a unique ID of an accepted message.
+func newQueueID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate message ID")
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,466 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/i-core/rlog"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// BounceConfig is configuration for processing of delivery status notifications (bounces) of emails.
+// Bounces are read from a POP3 mailbox that receives emails to the sender address.
+type BounceConfig struct {
+	Host      string        `envconfig:"host" desc:"a host of a POP3 server with a mailbox that receives bounces; bounces are not processed when it is empty"`
+	Port      int           `envconfig:"port" default:"995" desc:"a port of a POP3 server"`
+	TLS       bool          `envconfig:"tls" default:"true" desc:"use implicit TLS to connect to a POP3 server"`
+	Username  string        `envconfig:"username" desc:"a username of a POP3 mailbox"`
+	Password  string        `envconfig:"password" json:"-" desc:"a password of a POP3 mailbox"`
+	Interval  time.Duration `envconfig:"interval" default:"1m" desc:"an interval to check a POP3 mailbox for bounces"`
+	Retention time.Duration `envconfig:"retention" default:"72h" desc:"a time during which bounces are correlated with sent emails"`
+	Disable   bool          `envconfig:"disable" default:"false" desc:"stop sending emails to recipients of a target after a permanent bounce"`
+	StateFile string        `envconfig:"state_file" desc:"a path to a file where sent emails and bouncing recipients are stored to keep them after a restart; they are kept in memory only when it is empty"`
+}
+
+// Bounce is a permanent delivery failure of emails to a recipient of a target.
+type Bounce struct {
+	Target    string `json:"target"`
+	Recipient string `json:"recipient"`
+	// Status is a status code of the failure (https://tools.ietf.org/html/rfc3463), e.g. 5.1.1 for an unknown mailbox.
+	Status string `json:"status"`
+	// Diagnostic is a diagnostic message of the server that rejected an email.
+	Diagnostic string    `json:"diagnostic,omitempty"`
+	MessageID  string    `json:"message_id"`
+	Time       time.Time `json:"time"`
+	// Count is a number of bounced emails.
+	Count int `json:"count"`
+	// Disabled is true if emails are not sent to the recipient of the target anymore.
+	Disabled bool `json:"disabled"`
+}
+
+// sentMail is an email that can bounce.
+type sentMail struct {
+	ID     string    `json:"id"`
+	Target string    `json:"target"`
+	Rcpts  []string  `json:"recipients"`
+	At     time.Time `json:"at"`
+}
+
+// bounceState is the state of Bounces that is stored in the state file.
+type bounceState struct {
+	Sent     []*sentMail `json:"sent"`
+	Bouncing []Bounce    `json:"bouncing"`
+}
+
+// bounceKey identifies a recipient of a target.
+type bounceKey struct {
+	target string
+	rcpt   string
+}
+
+// Bounces correlates delivery status notifications (DSN) with sent emails by Message-ID,
+// and marks the recipients that the emails were not delivered to as bouncing.
+type Bounces struct {
+	cnf BounceConfig
+
+	mu sync.Mutex
+	// sent are emails that are sent during the retention time, by their Message-IDs.
+	sent map[string]*sentMail
+	// order is the emails in the order of their sending; it is used to forget emails after the retention time.
+	order    []*sentMail
+	bouncing map[bounceKey]*Bounce
+	// saveMu serializes writes of the state file.
+	saveMu sync.Mutex
+}
+
+// NewBounces returns a new Bounces.
+func NewBounces(cnf BounceConfig) *Bounces {
+	return &Bounces{cnf: cnf, sent: make(map[string]*sentMail), bouncing: make(map[bounceKey]*Bounce)}
+}
+
+// enabled returns true if bounces are processed.
+func (b *Bounces) enabled() bool {
+	return b != nil && b.cnf.Host != ""
+}
+
+// track remembers an email to correlate bounces with it.
+func (b *Bounces) track(id, target string, rcpts []string) {
+	if !b.enabled() {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.order) != 0 && now.Sub(b.order[0].At) > b.cnf.Retention {
+		delete(b.sent, b.order[0].ID)
+		b.order = b.order[1:]
+	}
+	m := &sentMail{ID: id, Target: target, Rcpts: rcpts, At: now}
+	b.sent[id] = m
+	b.order = append(b.order, m)
+}
+
+// filter returns recipients of a target that are not disabled because of bounces.
+func (b *Bounces) filter(target string, rcpts []string) []string {
+	if !b.enabled() || !b.cnf.Disable {
+		return rcpts
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var active []string
+	for _, rcpt := range rcpts {
+		if v, ok := b.bouncing[bounceKey{target, strings.ToLower(rcpt)}]; !ok || !v.Disabled {
+			active = append(active, rcpt)
+		}
+	}
+	return active
+}
+
+// Restore loads the sent emails and the bouncing recipients from the state file, so they are kept after a restart.
+// Sent emails that are older than the retention time are skipped.
+func (b *Bounces) Restore() error {
+	if !b.enabled() || b.cnf.StateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.cnf.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read bounce state")
+	}
+	var state bounceState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return errors.Wrapf(err, "invalid bounce state %q", b.cnf.StateFile)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range state.Sent {
+		if time.Since(m.At) <= b.cnf.Retention {
+			b.sent[m.ID] = m
+			b.order = append(b.order, m)
+		}
+	}
+	for i := range state.Bouncing {
+		v := &state.Bouncing[i]
+		b.bouncing[bounceKey{v.Target, strings.ToLower(v.Recipient)}] = v
+	}
+	return nil
+}
+
+// save writes the sent emails and the bouncing recipients to the state file.
+func (b *Bounces) save() error {
+	if b.cnf.StateFile == "" {
+		return nil
+	}
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+	state := bounceState{Bouncing: b.list()}
+	b.mu.Lock()
+	state.Sent = append(state.Sent, b.order...)
+	b.mu.Unlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal bounce state")
+	}
+	if err = writeFileAtomic(b.cnf.StateFile, data); err != nil {
+		return errors.Wrap(err, "failed to store bounce state")
+	}
+	return nil
+}
+
+// list returns the bouncing recipients sorted by targets and recipients.
+func (b *Bounces) list() []Bounce {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]Bounce, 0, len(b.bouncing))
+	for _, v := range b.bouncing {
+		list = append(list, *v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Target != list[j].Target {
+			return list[i].Target < list[j].Target
+		}
+		return list[i].Recipient < list[j].Recipient
+	})
+	return list
+}
+
+// reset removes a recipient of a target from the bouncing recipients, so emails are sent to the recipient again.
+// The method returns false if the recipient is not bouncing.
+func (b *Bounces) reset(target, rcpt string) bool {
+	key := bounceKey{target, strings.ToLower(rcpt)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.bouncing[key]
+	delete(b.bouncing, key)
+	return ok
+}
+
+// process processes an email that may be a delivery status notification.
+// The method returns the recipients that are marked as bouncing, and false if the email is not a delivery status notification.
+// A notification that cannot be correlated with a sent email, e.g. after the retention time, is processed but ignored.
+func (b *Bounces) process(data []byte) ([]Bounce, bool) {
+	id, rcpts, ok := parseDSN(data)
+	if !ok {
+		return nil, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.sent[id]
+	if !ok {
+		return nil, true
+	}
+	var bounces []Bounce
+	for _, r := range rcpts {
+		if r.action != "failed" || !containsFold(m.Rcpts, r.addr) {
+			continue
+		}
+		key := bounceKey{m.Target, strings.ToLower(r.addr)}
+		v, ok := b.bouncing[key]
+		if !ok {
+			v = &Bounce{Target: m.Target, Recipient: key.rcpt}
+			b.bouncing[key] = v
+		}
+		v.Status, v.Diagnostic, v.MessageID, v.Time = r.status, r.diagnostic, id, time.Now()
+		v.Count++
+		v.Disabled = b.cnf.Disable
+		bounces = append(bounces, *v)
+	}
+	return bounces, true
+}
+
+func containsFold(ss []string, s string) bool {
+	for _, v := range ss {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run checks the POP3 mailbox for bounces every interval until the context is canceled.
+// Delivery status notifications are deleted from the mailbox after processing; other emails are left in it.
+// The state file is updated after every check, so emails that are sent after the last check are not correlated
+// with bounces after a restart. A check in progress is finished before the function returns.
+func (b *Bounces) Run(ctx context.Context, log *zap.Logger) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		bounces, err := b.poll()
+		if err != nil {
+			log.Info("Failed to check bounces", zap.Error(err))
+		}
+		for _, v := range bounces {
+			log.Warn("Email bounced", zap.String("target", v.Target), zap.String("recipient", v.Recipient),
+				zap.String("status", v.Status), zap.String("diagnostic", v.Diagnostic), zap.Bool("disabled", v.Disabled))
+		}
+		if err = b.save(); err != nil {
+			log.Info("Failed to save bounces", zap.Error(err))
+		}
+		timer.Reset(b.cnf.Interval)
+	}
+}
+
+// poll processes the emails in the POP3 mailbox and returns the recipients that are marked as bouncing.
+func (b *Bounces) poll() ([]Bounce, error) {
+	c, err := dialPOP3(b.cnf)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	n, err := c.count()
+	if err != nil {
+		return nil, err
+	}
+	var bounces []Bounce
+	for i := 1; i <= n; i++ {
+		data, err := c.retr(i)
+		if err != nil {
+			return bounces, err
+		}
+		v, ok := b.process(data)
+		bounces = append(bounces, v...)
+		if !ok {
+			continue
+		}
+		if err = c.dele(i); err != nil {
+			return bounces, err
+		}
+	}
+	// Deleted emails are removed from the mailbox only when the session ends successfully.
+	return bounces, c.quit()
+}
+
+// AddRoutes registers routes to list the bouncing recipients and to reset them.
+func (b *Bounces) AddRoutes(apply func(m, p string, h http.Handler, mws ...func(http.Handler) http.Handler)) {
+	apply(http.MethodGet, "", newBounceListHandler(b))
+	apply(http.MethodDelete, "", newBounceResetHandler(b))
+}
+
+// newBounceListHandler returns an HTTP handler that responds with the list of the bouncing recipients.
+func newBounceListHandler(b *Bounces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := rlog.FromContext(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(b.list()); err != nil {
+			log.Info("Failed to marshal bounces", zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// newBounceResetHandler returns an HTTP handler that resets a bouncing recipient of a target.
+// An HTTP request must contain query parameters "target" and "recipient".
+// The route is not authenticated, so every reset is logged with the client's address.
+func newBounceResetHandler(b *Bounces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := rlog.FromContext(r.Context()).Sugar()
+		target, rcpt := r.URL.Query().Get("target"), r.URL.Query().Get("recipient")
+		if target == "" || rcpt == "" {
+			msg := fmt.Sprintln("Parameters 'target' and 'recipient' are required")
+			http.Error(w, msg, http.StatusBadRequest)
+			log.Debug(msg)
+			return
+		}
+		if !b.reset(target, rcpt) {
+			http.Error(w, fmt.Sprintf("Recipient %q of target %q is not bouncing", rcpt, target), http.StatusNotFound)
+			return
+		}
+		log.Infow("Bouncing recipient is enabled", zap.String("target", target), zap.String("recipient", rcpt),
+			zap.String("remoteAddr", r.RemoteAddr), zap.String("userAgent", r.UserAgent()))
+		// The recipient is enabled anyway, but it is disabled again after a restart if the state is not saved.
+		if err := b.save(); err != nil {
+			log.Infow("Failed to save bounces", zap.Error(err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// dsnRecipient is a per-recipient part of a delivery status notification.
+type dsnRecipient struct {
+	addr       string
+	action     string
+	status     string
+	diagnostic string
+}
+
+// parseDSN parses a delivery status notification (https://tools.ietf.org/html/rfc3464) and returns
+// the Message-ID of the original email and the statuses of its recipients.
+// The function returns false if an email is not a delivery status notification or it does not contain the Message-ID.
+func parseDSN(data []byte) (string, []dsnRecipient, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, false
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "delivery-status") {
+		return "", nil, false
+	}
+	var (
+		id    string
+		rcpts []dsnRecipient
+	)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, false
+		}
+		body, err := ioutil.ReadAll(partBody(part))
+		if err != nil {
+			return "", nil, false
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			rcpts = parseDSNRecipients(body)
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			// The original email can be truncated, so only its header is read.
+			h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(body))).ReadMIMEHeader()
+			id = strings.TrimSpace(h.Get("Message-Id"))
+		}
+	}
+	if id == "" {
+		return "", nil, false
+	}
+	return id, rcpts, true
+}
+
+// partBody returns a reader of a part's body that decodes base64. The package multipart decodes quoted-printable itself.
+func partBody(part *multipart.Part) io.Reader {
+	if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+		return base64.NewDecoder(base64.StdEncoding, part)
+	}
+	return part
+}
+
+// parseDSNRecipients parses the per-recipient fields of a delivery status (https://tools.ietf.org/html/rfc3464#section-2.3).
+// The fields are groups of header fields that follow the per-message fields and are separated by blank lines.
+func parseDSNRecipients(body []byte) []dsnRecipient {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(body)))
+	var rcpts []dsnRecipient
+	for {
+		h, err := r.ReadMIMEHeader()
+		if rcpt := dsnAddress(h.Get("Original-Recipient")); rcpt != "" || h.Get("Final-Recipient") != "" {
+			if rcpt == "" {
+				rcpt = dsnAddress(h.Get("Final-Recipient"))
+			}
+			rcpts = append(rcpts, dsnRecipient{
+				addr:       rcpt,
+				action:     strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+				status:     strings.TrimSpace(h.Get("Status")),
+				diagnostic: dsnValue(h.Get("Diagnostic-Code")),
+			})
+		}
+		if err != nil {
+			return rcpts
+		}
+	}
+}
+
+// dsnValue returns a value of a typed DSN field without its type, e.g. "550 User unknown" for "smtp; 550 User unknown".
+func dsnValue(field string) string {
+	if i := strings.IndexByte(field, ';'); i != -1 {
+		field = field[i+1:]
+	}
+	return strings.TrimSpace(field)
+}
+
+// dsnAddress returns an address of a recipient's DSN field, e.g. "user@example.org" for "rfc822; <user@example.org>".
+func dsnAddress(field string) string {
+	return strings.Trim(dsnValue(field), "<>")
+}
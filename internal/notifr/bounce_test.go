@@ -0,0 +1,311 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testDSN = `From: MAILER-DAEMON@example.org
+To: notifr@example.org
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="B"
+
+--B
+Content-Type: text/plain
+
+The mail system could not deliver the message.
+
+--B
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.org
+Arrival-Date: Mon, 2 Oct 2019 10:00:00 +0000
+
+Final-Recipient: rfc822; A@example.org
+Original-Recipient: rfc822;a@example.org
+Action: failed
+Status: 5.1.1
+Diagnostic-Code: smtp; 550 5.1.1 <a@example.org>: Recipient address rejected
+
+Final-Recipient: rfc822; b@example.org
+Action: delayed
+Status: 4.4.1
+
+--B
+Content-Type: text/rfc822-headers
+
+From: notifr@example.org
+To: a@example.org, b@example.org
+Subject: Test
+Message-ID: %s
+
+--B--
+`
+
+func TestParseDSN(t *testing.T) {
+	id, rcpts, ok := parseDSN([]byte(strings.Replace(fmt.Sprintf(testDSN, "<1@example.org>"), "\n", "\r\n", -1)))
+	if !ok {
+		t.Fatalf("got no delivery status notification; want notification")
+	}
+	if id != "<1@example.org>" {
+		t.Errorf("got Message-ID: %q; want Message-ID: %q", id, "<1@example.org>")
+	}
+	want := []dsnRecipient{
+		{addr: "a@example.org", action: "failed", status: "5.1.1", diagnostic: "550 5.1.1 <a@example.org>: Recipient address rejected"},
+		{addr: "b@example.org", action: "delayed", status: "4.4.1"},
+	}
+	if !reflect.DeepEqual(rcpts, want) {
+		t.Errorf("got recipients: %+v; want recipients: %+v", rcpts, want)
+	}
+
+	if _, _, ok = parseDSN([]byte("From: a@example.org\r\nSubject: Hello\r\n\r\nHello\r\n")); ok {
+		t.Errorf("got delivery status notification for a plain email; want no notification")
+	}
+}
+
+func TestBounces(t *testing.T) {
+	srv := &testPOP3Server{}
+	srv.start(t)
+	defer srv.close()
+
+	cnf := SMTPConfig{
+		From:    "notifr@example.org",
+		Retries: []time.Duration{0},
+		Bounce:  BounceConfig{Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass", Retention: time.Hour, Disable: true},
+	}
+	s := NewSMTPSender(cnf)
+	var sent [][]string
+	s.sendfn = func(from string, to []string, data []byte) error {
+		sent = append(sent, to)
+		if id := regexp.MustCompile(`Message-ID: (\S+)`).FindSubmatch(data); id != nil {
+			srv.mails = append(srv.mails, fmt.Sprintf(testDSN, id[1]), "From: a@example.org\nSubject: Hello\n\n.Hello\n")
+		}
+		return nil
+	}
+	rcpts := []string{"a@example.org", "b@example.org"}
+	if err := s.Send(rcpts, Message{Text: "Test", Target: "test"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	bounces, err := s.Bounces().poll()
+	if err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if len(bounces) != 1 || bounces[0].Recipient != "a@example.org" || bounces[0].Status != "5.1.1" || !bounces[0].Disabled {
+		t.Errorf("got bounces: %+v; want disabled recipient a@example.org with status 5.1.1", bounces)
+	}
+	if want := []string{"USER user", "PASS pass", "STAT", "RETR 1", "DELE 1", "RETR 2", "QUIT"}; !reflect.DeepEqual(srv.commands(), want) {
+		t.Errorf("got POP3 commands: %q; want POP3 commands: %q", srv.commands(), want)
+	}
+
+	if err = s.Send(rcpts, Message{Text: "Test", Target: "test"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if err = s.Send(rcpts, Message{Text: "Test", Target: "other"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if want := [][]string{rcpts, {"b@example.org"}, rcpts}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("got envelope recipients: %q; want envelope recipients: %q", sent, want)
+	}
+
+	rr := httptest.NewRecorder()
+	newBounceListHandler(s.Bounces()).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	var list []Bounce
+	if err = json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if len(list) != 1 || list[0].Target != "test" || list[0].Recipient != "a@example.org" || list[0].Count != 1 {
+		t.Errorf("got bounces: %+v; want bouncing recipient a@example.org of target test", list)
+	}
+
+	for _, tc := range []struct {
+		query      string
+		wantStatus int
+	}{
+		{query: "?target=test", wantStatus: http.StatusBadRequest},
+		{query: "?target=test&recipient=A@example.org", wantStatus: http.StatusNoContent},
+		{query: "?target=test&recipient=a@example.org", wantStatus: http.StatusNotFound},
+	} {
+		rr = httptest.NewRecorder()
+		newBounceResetHandler(s.Bounces()).ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/"+tc.query, nil))
+		if rr.Code != tc.wantStatus {
+			t.Errorf("query %q: got status: %d; want status: %d", tc.query, rr.Code, tc.wantStatus)
+		}
+	}
+	if got := s.Bounces().filter("test", rcpts); !reflect.DeepEqual(got, rcpts) {
+		t.Errorf("got recipients after reset: %q; want recipients: %q", got, rcpts)
+	}
+}
+
+func TestBouncesRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cnf := BounceConfig{Host: "127.0.0.1", Retention: time.Hour, Disable: true, StateFile: filepath.Join(dir, "bounces.json")}
+	b := NewBounces(cnf)
+	if err = b.Restore(); err != nil {
+		t.Fatalf("got error: %v; want no error for a missing state file", err)
+	}
+	b.track("<1@example.org>", "test", []string{"a@example.org", "b@example.org"})
+	b.track("<2@example.org>", "test", []string{"c@example.org"})
+	if _, ok := b.process([]byte(fmt.Sprintf(testDSN, "<1@example.org>"))); !ok {
+		t.Fatalf("got no delivery status notification; want notification")
+	}
+	if err = b.save(); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	// After a restart, the recipient is still disabled, and a bounce of an email that was sent before is correlated.
+	b2 := NewBounces(cnf)
+	if err = b2.Restore(); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if got, want := b2.filter("test", []string{"a@example.org", "b@example.org"}), []string{"b@example.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got recipients: %q; want recipients: %q", got, want)
+	}
+	dsn := strings.NewReplacer("A@example.org", "c@example.org", "a@example.org", "c@example.org").Replace(fmt.Sprintf(testDSN, "<2@example.org>"))
+	if bounces, _ := b2.process([]byte(dsn)); len(bounces) != 1 || bounces[0].Recipient != "c@example.org" {
+		t.Errorf("got bounces: %+v; want bouncing recipient c@example.org", bounces)
+	}
+
+	if err = ioutil.WriteFile(cnf.StateFile, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = NewBounces(cnf).Restore(); err == nil {
+		t.Errorf("got no error; want error for an invalid state file")
+	}
+}
+
+func TestBouncesRun(t *testing.T) {
+	srv := &testPOP3Server{}
+	srv.start(t)
+	defer srv.close()
+
+	dir, err := ioutil.TempDir("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewBounces(BounceConfig{
+		Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass",
+		Interval: time.Hour, Retention: time.Hour, StateFile: filepath.Join(dir, "bounces.json"),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx, zap.NewNop())
+		close(done)
+	}()
+	// The mailbox is checked right away, and the state is saved after the check.
+	waitFor(t, "saved state", func() bool {
+		_, err := os.Stat(b.cnf.StateFile)
+		return err == nil
+	})
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("got running check of bounces; want stopped check after the context is canceled")
+	}
+	if want := []string{"USER user", "PASS pass", "STAT", "QUIT"}; !reflect.DeepEqual(srv.commands(), want) {
+		t.Errorf("got POP3 commands: %q; want POP3 commands: %q", srv.commands(), want)
+	}
+}
+
+// testPOP3Server is a POP3 server that serves emails and records commands.
+type testPOP3Server struct {
+	mails []string
+
+	ln   net.Listener
+	mu   sync.Mutex
+	cmds []string
+}
+
+func (srv *testPOP3Server) start(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			srv.serve(textproto.NewConn(conn))
+		}
+	}()
+}
+
+func (srv *testPOP3Server) serve(c *textproto.Conn) {
+	defer c.Close()
+	c.PrintfLine("+OK POP3 server ready")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.cmds = append(srv.cmds, line)
+		srv.mu.Unlock()
+		var n int
+		switch {
+		case line == "STAT":
+			c.PrintfLine("+OK %d 0", len(srv.mails))
+		case strings.HasPrefix(line, "RETR "):
+			fmt.Sscanf(line, "RETR %d", &n)
+			c.PrintfLine("+OK")
+			w := c.DotWriter()
+			w.Write([]byte(srv.mails[n-1]))
+			w.Close()
+		case line == "QUIT":
+			c.PrintfLine("+OK")
+			return
+		default:
+			c.PrintfLine("+OK")
+		}
+	}
+}
+
+func (srv *testPOP3Server) commands() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.cmds...)
+}
+
+func (srv *testPOP3Server) port() int {
+	return srv.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (srv *testPOP3Server) close() {
+	srv.ln.Close()
+}
@@ -0,0 +1,470 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// inlineCSS moves rules of stylesheets of an HTML document to style attributes of the elements that the rules match,
+// and adjusts tables, code blocks and images for mail clients, since some of them (e.g. Gmail and Outlook) strip stylesheets.
+//
+// Only simple selectors are inlined: type, class, ID and universal selectors, the descendant and child combinators,
+// and the pseudo-classes :first-child, :last-child and :nth-child(). Other rules and at-rules (e.g. @media) cannot be inlined,
+// so they are left in a stylesheet.
+func inlineCSS(doc string) (string, error) {
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse HTML")
+	}
+
+	var (
+		rules  []cssRule
+		styles []*html.Node
+		body   *html.Node
+	)
+	walkHTML(root, func(n *html.Node) {
+		switch {
+		case n.DataAtom == atom.Style && n.FirstChild != nil:
+			styles = append(styles, n)
+		case n.DataAtom == atom.Body && body == nil:
+			body = n
+		}
+	})
+	for _, n := range styles {
+		var text strings.Builder
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			text.WriteString(c.Data)
+		}
+		inlined, rest := parseCSS(text.String(), len(rules))
+		rules = append(rules, inlined...)
+		if strings.TrimSpace(rest) == "" {
+			n.Parent.RemoveChild(n)
+			continue
+		}
+		n.FirstChild.Data = rest
+		for n.FirstChild.NextSibling != nil {
+			n.RemoveChild(n.FirstChild.NextSibling)
+		}
+	}
+
+	// Elements of the document's head are not displayed, so they are not styled.
+	walkHTML(body, func(n *html.Node) {
+		if n.Type != html.ElementNode {
+			return
+		}
+		var matched []cssRule
+		for _, r := range rules {
+			if r.selector.match(n) {
+				matched = append(matched, r)
+			}
+		}
+		// Rules with a higher specificity override others; rules with the same specificity are applied in the source order.
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].selector.specificity.less(matched[j].selector.specificity)
+		})
+		decls := compatDecls(n)
+		for _, r := range matched {
+			decls = append(decls, r.decls...)
+		}
+		// A style attribute overrides stylesheets.
+		decls = append(decls, parseCSSDecls(htmlAttr(n, "style"))...)
+		if len(decls) != 0 {
+			setHTMLAttr(n, "style", formatCSSDecls(decls))
+		}
+		compatAttrs(n)
+	})
+
+	var sb strings.Builder
+	if err = html.Render(&sb, root); err != nil {
+		return "", errors.Wrap(err, "failed to render HTML")
+	}
+	return sb.String(), nil
+}
+
+// compatDecls returns default styles of an element that make it look the same in different mail clients.
+// The styles are applied before any other styles, so stylesheets and style attributes override them.
+func compatDecls(n *html.Node) []cssDecl {
+	switch n.DataAtom {
+	case atom.Table:
+		return []cssDecl{{"border-collapse", "collapse"}}
+	case atom.Pre:
+		// Long lines of code are wrapped because many mail clients do not scroll code blocks.
+		return []cssDecl{{"font-family", "monospace"}, {"white-space", "pre-wrap"}, {"word-wrap", "break-word"}}
+	case atom.Code:
+		return []cssDecl{{"font-family", "monospace"}}
+	case atom.Img:
+		return []cssDecl{{"border", "0"}, {"max-width", "100%"}, {"height", "auto"}}
+	}
+	return nil
+}
+
+// compatAttrs sets presentational attributes of an element for mail clients that ignore CSS, e.g. Outlook.
+func compatAttrs(n *html.Node) {
+	switch n.DataAtom {
+	case atom.Table:
+		setDefaultHTMLAttr(n, "cellspacing", "0")
+		setDefaultHTMLAttr(n, "cellpadding", "4")
+	case atom.Img:
+		setDefaultHTMLAttr(n, "border", "0")
+		setDefaultHTMLAttr(n, "alt", "")
+	}
+}
+
+// walkHTML calls a function for every node of an HTML tree in the document order.
+func walkHTML(n *html.Node, fn func(n *html.Node)) {
+	fn(n)
+	for c := n.FirstChild; c != nil; {
+		// The next sibling is got in advance because the function can remove the child.
+		next := c.NextSibling
+		walkHTML(c, fn)
+		c = next
+	}
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setHTMLAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+// setDefaultHTMLAttr sets an attribute of an element if the element does not have it.
+func setDefaultHTMLAttr(n *html.Node, key, val string) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+// cssRule is a CSS rule with one selector.
+type cssRule struct {
+	selector cssSelector
+	decls    []cssDecl
+}
+
+// cssDecl is a CSS declaration.
+type cssDecl struct {
+	property string
+	value    string
+}
+
+var reCSSComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// parseCSS parses a stylesheet and returns the rules that can be inlined, and the text of the rest of the stylesheet.
+// The order of a rule is its index in all stylesheets of a document, so the rules of several stylesheets are applied in the source order.
+func parseCSS(css string, order int) ([]cssRule, string) {
+	css = reCSSComment.ReplaceAllString(css, "")
+	var (
+		rules []cssRule
+		rest  strings.Builder
+	)
+	for css = strings.TrimSpace(css); css != ""; css = strings.TrimSpace(css) {
+		open := strings.IndexByte(css, '{')
+		if open == -1 {
+			// An at-rule without a block, e.g. @import, or an invalid trailing text.
+			rest.WriteString(css)
+			break
+		}
+		end := cssBlockEnd(css, open)
+		prelude, block := strings.TrimSpace(css[:open]), css[open:end]
+		// An at-rule without a block ends with a semicolon.
+		if strings.HasPrefix(prelude, "@") && strings.IndexByte(prelude, ';') != -1 {
+			i := strings.IndexByte(css, ';') + 1
+			rest.WriteString(css[:i] + "\n")
+			css = css[i:]
+			continue
+		}
+		css = css[end:]
+		if strings.HasPrefix(prelude, "@") {
+			rest.WriteString(prelude + block + "\n")
+			continue
+		}
+		decls := parseCSSDecls(strings.Trim(block, "{}"))
+		var kept []string
+		for _, s := range strings.Split(prelude, ",") {
+			sel, ok := parseCSSSelector(s)
+			if !ok {
+				kept = append(kept, strings.TrimSpace(s))
+				continue
+			}
+			sel.specificity.order = order
+			order++
+			rules = append(rules, cssRule{selector: sel, decls: decls})
+		}
+		if len(kept) != 0 {
+			rest.WriteString(strings.Join(kept, ",") + block + "\n")
+		}
+	}
+	return rules, rest.String()
+}
+
+// cssBlockEnd returns an index after the end of a block that starts at an index of an opening brace.
+func cssBlockEnd(css string, open int) int {
+	depth := 0
+	for i := open; i < len(css); i++ {
+		switch css[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(css)
+}
+
+// parseCSSDecls parses CSS declarations of a block or a style attribute.
+func parseCSSDecls(s string) []cssDecl {
+	var decls []cssDecl
+	for _, d := range strings.Split(s, ";") {
+		i := strings.IndexByte(d, ':')
+		if i == -1 {
+			continue
+		}
+		prop, val := strings.ToLower(strings.TrimSpace(d[:i])), strings.TrimSpace(d[i+1:])
+		if prop != "" && val != "" {
+			decls = append(decls, cssDecl{property: prop, value: val})
+		}
+	}
+	return decls
+}
+
+// formatCSSDecls formats CSS declarations to a style attribute.
+// When a property is declared several times, the last declaration wins.
+func formatCSSDecls(decls []cssDecl) string {
+	var (
+		props []string
+		vals  = make(map[string]string)
+	)
+	for _, d := range decls {
+		if _, ok := vals[d.property]; !ok {
+			props = append(props, d.property)
+		}
+		vals[d.property] = d.value
+	}
+	parts := make([]string, len(props))
+	for i, p := range props {
+		parts[i] = p + ": " + vals[p]
+	}
+	return strings.Join(parts, "; ")
+}
+
+// cssSelector is a CSS selector that consists of compound selectors joined with combinators.
+type cssSelector struct {
+	// compounds are compound selectors in the reverse order, from the subject of a selector to its first compound.
+	compounds   []cssCompound
+	specificity cssSpecificity
+}
+
+// cssCompound is a compound selector, e.g. "td.error:first-child".
+type cssCompound struct {
+	tag     string
+	id      string
+	classes []string
+	pseudos []string
+	// child is true if the compound is joined with a previous one with the child combinator.
+	child bool
+}
+
+// cssSpecificity is a specificity of a selector (https://www.w3.org/TR/selectors-3/#specificity)
+// with the rule's order in stylesheets.
+type cssSpecificity struct {
+	ids, classes, tags, order int
+}
+
+func (a cssSpecificity) less(b cssSpecificity) bool {
+	if a.ids != b.ids {
+		return a.ids < b.ids
+	}
+	if a.classes != b.classes {
+		return a.classes < b.classes
+	}
+	if a.tags != b.tags {
+		return a.tags < b.tags
+	}
+	return a.order < b.order
+}
+
+var (
+	reCSSCompound = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9]*|\*)?((?:[.#][a-zA-Z_-][a-zA-Z0-9_-]*|:[a-z-]+(?:\([^)]*\))?)*)$`)
+	reCSSSimple   = regexp.MustCompile(`[.#][a-zA-Z_-][a-zA-Z0-9_-]*|:[a-z-]+(?:\([^)]*\))?`)
+	reCSSNth      = regexp.MustCompile(`^:nth-child\(\s*(odd|even|[0-9]+)\s*\)$`)
+)
+
+// parseCSSSelector parses a selector. The function returns false if the selector is not supported.
+func parseCSSSelector(s string) (cssSelector, bool) {
+	var (
+		sel   cssSelector
+		child bool
+	)
+	fields := strings.Fields(strings.Replace(s, ">", " > ", -1))
+	if len(fields) == 0 {
+		return sel, false
+	}
+	for _, f := range fields {
+		if f == ">" {
+			if child || len(sel.compounds) == 0 {
+				return sel, false
+			}
+			child = true
+			continue
+		}
+		m := reCSSCompound.FindStringSubmatch(f)
+		if m == nil {
+			return sel, false
+		}
+		c := cssCompound{tag: strings.ToLower(m[1]), child: child}
+		child = false
+		if c.tag == "*" {
+			c.tag = ""
+		} else if c.tag != "" {
+			sel.specificity.tags++
+		}
+		for _, simple := range reCSSSimple.FindAllString(m[2], -1) {
+			switch simple[0] {
+			case '#':
+				c.id = simple[1:]
+				sel.specificity.ids++
+			case '.':
+				c.classes = append(c.classes, simple[1:])
+				sel.specificity.classes++
+			case ':':
+				if simple != ":first-child" && simple != ":last-child" && !reCSSNth.MatchString(simple) {
+					return sel, false
+				}
+				c.pseudos = append(c.pseudos, simple)
+				sel.specificity.classes++
+			}
+		}
+		sel.compounds = append([]cssCompound{c}, sel.compounds...)
+	}
+	if child {
+		return sel, false
+	}
+	return sel, true
+}
+
+// match returns true if a selector matches an element.
+func (sel cssSelector) match(n *html.Node) bool {
+	return matchCSSCompounds(sel.compounds, n)
+}
+
+func matchCSSCompounds(compounds []cssCompound, n *html.Node) bool {
+	if !compounds[0].match(n) {
+		return false
+	}
+	if len(compounds) == 1 {
+		return true
+	}
+	// The combinator between the compound and the next one is stored in the compound.
+	for p := n.Parent; p != nil && p.Type == html.ElementNode; p = p.Parent {
+		if matchCSSCompounds(compounds[1:], p) {
+			return true
+		}
+		if compounds[0].child {
+			return false
+		}
+	}
+	return false
+}
+
+// match returns true if a compound selector matches an element.
+func (c cssCompound) match(n *html.Node) bool {
+	if n.Type != html.ElementNode || (c.tag != "" && c.tag != n.Data) {
+		return false
+	}
+	if c.id != "" && htmlAttr(n, "id") != c.id {
+		return false
+	}
+	if len(c.classes) != 0 {
+		classes := strings.Fields(htmlAttr(n, "class"))
+		for _, want := range c.classes {
+			found := false
+			for _, cls := range classes {
+				if cls == want {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	for _, pseudo := range c.pseudos {
+		index, count := elementIndex(n)
+		switch pseudo {
+		case ":first-child":
+			if index != 1 {
+				return false
+			}
+		case ":last-child":
+			if index != count {
+				return false
+			}
+		default:
+			switch arg := reCSSNth.FindStringSubmatch(pseudo)[1]; arg {
+			case "odd":
+				if index%2 != 1 {
+					return false
+				}
+			case "even":
+				if index%2 != 0 {
+					return false
+				}
+			default:
+				if nth, _ := strconv.Atoi(arg); index != nth {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// elementIndex returns a 1-based index of an element among its sibling elements, and a number of the sibling elements.
+func elementIndex(n *html.Node) (int, int) {
+	if n.Parent == nil {
+		return 1, 1
+	}
+	var index, count int
+	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		count++
+		if c == n {
+			index = count
+		}
+	}
+	return index, count
+}
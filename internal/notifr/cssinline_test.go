@@ -0,0 +1,82 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInlineCSS(t *testing.T) {
+	testCases := []struct {
+		name    string
+		html    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "type and class selectors",
+			html: `<style>p{color: black; margin: 0} .error{color: red}</style><p>A</p><p class="error">B</p>`,
+			want: []string{`<p style="color: black; margin: 0">A</p>`, `<p class="error" style="color: red; margin: 0">B</p>`},
+		},
+		{
+			name: "specificity and style attribute",
+			html: `<style>#id{color: red} p.a{color: green} p{color: blue}</style><p id="id" class="a">A</p><p class="a" style="color: black">B</p>`,
+			want: []string{`<p id="id" class="a" style="color: red">A</p>`, `<p class="a" style="color: black">B</p>`},
+		},
+		{
+			name: "combinators and pseudo-classes",
+			html: `<style>table > tr:nth-child(even) td{background: grey} div td:first-child{font-weight: bold}</style>` +
+				`<div><table><tbody><tr><td>1</td><td>2</td></tr><tr><td>3</td></tr></tbody></table></div>`,
+			want: []string{`<td style="font-weight: bold">1</td><td>2</td>`, `<td style="font-weight: bold">3</td>`},
+		},
+		{
+			name: "child combinator",
+			html: `<style>tbody > tr:nth-child(even) > td{background: grey}</style><table><tbody><tr><td>1</td></tr><tr><td>2</td></tr></tbody></table>`,
+			want: []string{`<td>1</td>`, `<td style="background: grey">2</td>`},
+		},
+		{
+			name:    "not inlined rules",
+			html:    `<style>a:hover{color: red} a{color: blue} @media (prefers-color-scheme: dark){a{color: white}}</style><a href="#">A</a>`,
+			want:    []string{"<style>a:hover{color: red}\n@media (prefers-color-scheme: dark){a{color: white}}\n</style>", `<a href="#" style="color: blue">A</a>`},
+			notWant: []string{"a{color: blue}"},
+		},
+		{
+			name:    "stylesheet is removed",
+			html:    `<html><head><style>/* borders */ table,th,td{border: 1px solid black}</style></head><body><table><tbody><tr><td>1</td></tr></tbody></table></body></html>`,
+			want:    []string{`<table style="border-collapse: collapse; border: 1px solid black" cellspacing="0" cellpadding="4">`, `<td style="border: 1px solid black">1</td>`},
+			notWant: []string{"<style>"},
+		},
+		{
+			name: "code blocks and images",
+			html: `<pre><code>x := 1</code></pre><img src="cid:chart.png" width="600"/>`,
+			want: []string{
+				`<pre style="font-family: monospace; white-space: pre-wrap; word-wrap: break-word"><code style="font-family: monospace">`,
+				`<img src="cid:chart.png" width="600" style="border: 0; max-width: 100%; height: auto" border="0" alt=""/>`,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := inlineCSS(tc.html)
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("got HTML: %q; want HTML that contains: %q", got, want)
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("got HTML: %q; want HTML that does not contain: %q", got, notWant)
+				}
+			}
+		})
+	}
+}
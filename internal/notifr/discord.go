@@ -0,0 +1,139 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DiscordConfig is configuration for Discord webhooks.
+type DiscordConfig struct {
+	Timeout        time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Discord"`
+	Retries        []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+	RateLimitWaits int             `envconfig:"rate_limit_waits" default:"10" desc:"a maximum number of waits for a rate limit before a retry interval is used"`
+}
+
+// DiscordSender is a message sender that sends a message as an embed to Discord webhooks.
+// Recipients of the delivery are webhook URLs.
+type DiscordSender struct {
+	DiscordConfig
+	client *http.Client
+}
+
+// NewDiscordSender returns a new DiscordSender.
+func NewDiscordSender(cnf DiscordConfig) *DiscordSender {
+	return &DiscordSender{
+		DiscordConfig: cnf,
+		client:        &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// Discord limits the length of embeds' fields (https://discord.com/developers/docs/resources/message#embed-object-embed-limits).
+const (
+	discordTitleMaxLen       = 256
+	discordDescriptionMaxLen = 4096
+)
+
+// discordMessage is a payload of Discord webhooks (https://discord.com/developers/docs/resources/webhook#execute-webhook).
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Color       int    `json:"color,omitempty"`
+}
+
+// discordColors are colors of embeds for severities of messages.
+var discordColors = map[string]int{
+	"critical": 0xd83c3e,
+	"error":    0xd83c3e,
+	"warning":  0xf2c744,
+	"info":     0x3498db,
+	"ok":       0x2eb67d,
+	"resolved": 0x2eb67d,
+}
+
+// Send sends a message to Discord webhooks.
+// A message's text is put into the description of an embed because the description allows 4096 characters
+// unlike the message's content that allows only 2000 characters.
+// A text that exceeds the limit is split into several consecutive messages, and only the first message has a title.
+//
+// The method waits as long as Discord requests in the header Retry-After when it responds with the status 429.
+// Other temporary errors are retried according to the configured intervals.
+func (s *DiscordSender) Send(recipients []string, msg Message) error {
+	var payloads []*discordMessage
+	for _, embed := range newDiscordEmbeds(msg) {
+		payloads = append(payloads, &discordMessage{Embeds: []discordEmbed{embed}})
+	}
+	return sendEach(recipients, msg, func(url string) error {
+		for _, payload := range payloads {
+			if err := retry(s.Retries, func() error { return s.post(url, payload) }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// post sends a payload to a webhook and waits when Discord limits the rate of requests.
+func (s *DiscordSender) post(url string, payload *discordMessage) error {
+	for i := 0; ; i++ {
+		err := hideURL(postJSON(s.client, url, payload, nil))
+		v, ok := err.(*httpError)
+		if !ok || v.code != http.StatusTooManyRequests || v.retryAfter == 0 || i >= s.RateLimitWaits {
+			return err
+		}
+		time.Sleep(v.retryAfter)
+	}
+}
+
+// newDiscordEmbeds converts a message to Discord embeds.
+func newDiscordEmbeds(msg Message) []discordEmbed {
+	color := discordColors[strings.ToLower(msg.Severity)]
+	var embeds []discordEmbed
+	for _, chunk := range splitText(discordRenderer.render(msg.Text), discordDescriptionMaxLen) {
+		embeds = append(embeds, discordEmbed{Description: chunk, Color: color})
+	}
+	if len(embeds) == 0 {
+		embeds = append(embeds, discordEmbed{Color: color})
+	}
+	embeds[0].Title = truncateText(msg.Subject, discordTitleMaxLen)
+	return embeds
+}
+
+// discordEscaper escapes characters of Discord Markdown.
+var discordEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`)
+
+// discordRenderer renders Markdown to the Markdown dialect of Discord
+// (https://support.discord.com/hc/en-us/articles/210298617-Markdown-Text-101-Chat-Formatting-Bold-Italic-Underline).
+var discordRenderer = &textRenderer{
+	escape: discordEscaper.Replace,
+	emph:   [2]string{"*", "*"},
+	strong: [2]string{"**", "**"},
+	del:    [2]string{"~~", "~~"},
+	code: func(code string) string {
+		if strings.Contains(code, "`") {
+			return "`` " + code + " ``"
+		}
+		return "`" + code + "`"
+	},
+	codeBlock: func(lang, code string) string { return "```" + lang + "\n" + code + "\n```" },
+	link: func(dest, text string) string {
+		if text == "" {
+			return dest
+		}
+		return "[" + text + "](" + dest + ")"
+	},
+	quote:  func(blocks []string) string { return prefixLines(strings.Join(blocks, "\n"), "> ", "> ") },
+	hr:     "───",
+	bullet: "- ",
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDiscordEmbeds(t *testing.T) {
+	longText := strings.Repeat("a", 3000) + "\n\n" + strings.Repeat("b", 3000)
+	testCases := []struct {
+		name string
+		msg  Message
+		want []discordEmbed
+	}{
+		{
+			name: "formatting",
+			msg:  Message{Subject: "Alert", Text: "**Disk** is full on db_1, run `rm *.log`", Severity: "Critical"},
+			want: []discordEmbed{
+				{Title: "Alert", Description: "**Disk** is full on db\\_1, run `rm *.log`", Color: 0xd83c3e},
+			},
+		},
+		{
+			name: "unknown severity",
+			msg:  Message{Text: "Disk is full", Severity: "unknown"},
+			want: []discordEmbed{{Description: "Disk is full"}},
+		},
+		{
+			name: "long text",
+			msg:  Message{Subject: strings.Repeat("s", 300), Text: longText},
+			want: []discordEmbed{
+				{Title: strings.Repeat("s", 256), Description: strings.Repeat("a", 3000)},
+				{Description: strings.Repeat("b", 3000)},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := newDiscordEmbeds(tc.msg); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got embeds: %+v; want embeds: %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiscordSender(t *testing.T) {
+	testCases := []struct {
+		name         string
+		statuses     []int
+		retryAfter   string
+		wantRequests int
+		wantErr      bool
+	}{
+		{
+			name:         "rate limited",
+			statuses:     []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusNoContent},
+			retryAfter:   "0.01",
+			wantRequests: 3,
+		},
+		{
+			name:         "rate limited without Retry-After",
+			statuses:     []int{http.StatusTooManyRequests, http.StatusNoContent},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "permanent error",
+			statuses:     []int{http.StatusBadRequest},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var cnt int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var payload discordMessage
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					t.Errorf("failed to decode payload: %s", err)
+				}
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(tc.statuses[cnt])
+				cnt++
+			}))
+			defer srv.Close()
+
+			// The only retry interval means that the sender does not retry temporary errors except the rate limit.
+			sender := NewDiscordSender(DiscordConfig{Retries: []time.Duration{0}, RateLimitWaits: 5})
+			err := sender.Send([]string{srv.URL}, Message{Text: "Test"})
+
+			if cnt != tc.wantRequests {
+				t.Errorf("got requests: %d; want requests: %d", cnt, tc.wantRequests)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DKIMConfig is configuration for DKIM signing of emails.
+type DKIMConfig struct {
+	Domain   string `envconfig:"domain" desc:"a signing domain of DKIM signatures"`
+	Selector string `envconfig:"selector" desc:"a selector of a DKIM public key in DNS"`
+	KeyFile  string `envconfig:"key_file" desc:"a path to a PEM file with an RSA or Ed25519 private key; DKIM signing is disabled when it is empty"`
+}
+
+// dkimHeaders are names of header fields that are signed if an email contains them.
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// signDKIM adds a DKIM signature to an email (https://tools.ietf.org/html/rfc6376).
+// The header and the body are canonicalized with the "relaxed" algorithm.
+// The function returns an email with CRLF line endings because the signature is computed for them.
+func signDKIM(cnf DKIMConfig, data []byte, ts time.Time) ([]byte, error) {
+	signer, algo, err := loadDKIMKey(cnf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	data = crlf(data)
+	header, body := data, []byte{}
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i != -1 {
+		header, body = data[:i+2], data[i+4:]
+	}
+	fields := splitHeaderFields(string(header))
+
+	var (
+		names  []string
+		signed strings.Builder
+	)
+	for _, name := range dkimHeaders {
+		// The last instance of a field is signed (https://tools.ietf.org/html/rfc6376#section-5.4.2).
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(headerFieldName(fields[i]), name) {
+				names = append(names, strings.ToLower(name))
+				signed.WriteString(relaxedHeader(fields[i]))
+				break
+			}
+		}
+	}
+
+	bh := sha256.Sum256(relaxedBody(body))
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algo, cnf.Domain, cnf.Selector, ts.Unix(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	signed.WriteString(strings.TrimSuffix(relaxedHeader(sig), "\r\n"))
+
+	b, err := signer(sha256.Sum256([]byte(signed.String())))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign email")
+	}
+	return append([]byte(sig+base64.StdEncoding.EncodeToString(b)+"\r\n"), data...), nil
+}
+
+// loadDKIMKey loads a private key from a PEM file and returns a function that signs a SHA-256 hash, and a name of the signing algorithm.
+func loadDKIMKey(path string) (func(hash [sha256.Size]byte) ([]byte, error), string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to read DKIM key")
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, "", fmt.Errorf("no PEM data in DKIM key %q", path)
+	}
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to parse DKIM key")
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return func(hash [sha256.Size]byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		}, "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		// Ed25519 signs the SHA-256 hash of the header (https://tools.ietf.org/html/rfc8463).
+		return func(hash [sha256.Size]byte) ([]byte, error) {
+			return ed25519.Sign(k, hash[:]), nil
+		}, "ed25519-sha256", nil
+	}
+	return nil, "", fmt.Errorf("unsupported type of DKIM key %T", key)
+}
+
+// splitHeaderFields splits an email header with CRLF line endings to fields with their folded lines.
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		switch {
+		case line == "":
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) != 0:
+			fields[len(fields)-1] += line
+		default:
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+func headerFieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i != -1 {
+		return strings.TrimSpace(field[:i])
+	}
+	return ""
+}
+
+// relaxedHeader canonicalizes a header field with the "relaxed" algorithm (https://tools.ietf.org/html/rfc6376#section-3.4.2).
+func relaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i == -1 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	return name + ":" + strings.TrimSpace(compressWSP(value)) + "\r\n"
+}
+
+// relaxedBody canonicalizes a body with the "relaxed" algorithm (https://tools.ietf.org/html/rfc6376#section-3.4.4).
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(compressWSP(line), " ")
+	}
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// compressWSP replaces every sequence of spaces and tabs with a single space.
+func compressWSP(s string) string {
+	var (
+		sb  strings.Builder
+		wsp bool
+	)
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			sb.WriteByte(' ')
+			wsp = false
+		}
+		sb.WriteRune(r)
+	}
+	if wsp {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The examples of the relaxed canonicalization are from RFC 6376 (https://tools.ietf.org/html/rfc6376#section-3.4.5).
+func TestRelaxedCanonicalization(t *testing.T) {
+	var header strings.Builder
+	for _, field := range splitHeaderFields("A: X\r\nB : Y\t\r\n\tZ  \r\n") {
+		header.WriteString(relaxedHeader(field))
+	}
+	if got, want := header.String(), "a:X\r\nb:Y Z\r\n"; got != want {
+		t.Errorf("got header: %q; want header: %q", got, want)
+	}
+	if got, want := string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))), " C\r\nD E\r\n"; got != want {
+		t.Errorf("got body: %q; want body: %q", got, want)
+	}
+}
+
+func TestSignDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		key      *pem.Block
+		wantAlgo string
+		verify   func(hash, sig []byte) bool
+	}{
+		{
+			name:     "rsa",
+			key:      &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+			wantAlgo: "rsa-sha256",
+			verify: func(hash, sig []byte) bool {
+				return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, hash, sig) == nil
+			},
+		},
+		{
+			name:     "ed25519",
+			key:      &pem.Block{Type: "PRIVATE KEY", Bytes: edDER},
+			wantAlgo: "ed25519-sha256",
+			verify: func(hash, sig []byte) bool {
+				return ed25519.Verify(edPub, hash, sig)
+			},
+		},
+	}
+	mail := "From: notifr@example.org\nTo: email@example.org\nSubject: Test\nX-Mailer: test\n\nHello,  world!\n\n"
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cnf := DKIMConfig{Domain: "example.org", Selector: "notifr", KeyFile: testWriteFile(t, string(pem.EncodeToMemory(tc.key)))}
+			got, err := signDKIM(cnf, []byte(mail), time.Unix(1570000000, 0))
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+
+			fields := splitHeaderFields(string(got[:strings.Index(string(got), "\r\n\r\n")+2]))
+			sig := strings.TrimSuffix(fields[0], "\r\n")
+			wantPrefix := "DKIM-Signature: v=1; a=" + tc.wantAlgo + "; c=relaxed/relaxed; d=example.org; s=notifr; t=1570000000; h=from:subject:to; bh="
+			if !strings.HasPrefix(sig, wantPrefix) {
+				t.Fatalf("got signature: %q; want signature with prefix: %q", sig, wantPrefix)
+			}
+			bh := sha256.Sum256([]byte("Hello, world!\r\n"))
+			if !strings.Contains(sig, "bh="+base64.StdEncoding.EncodeToString(bh[:])+";") {
+				t.Errorf("got signature: %q; want body hash of %q", sig, "Hello, world!\r\n")
+			}
+
+			i := strings.LastIndex(sig, "b=") + 2
+			b, err := base64.StdEncoding.DecodeString(sig[i:])
+			if err != nil {
+				t.Fatalf("failed to decode signature: %s", err)
+			}
+			signed := relaxedHeader(fields[1]) + relaxedHeader(fields[3]) + relaxedHeader(fields[2]) +
+				strings.TrimSuffix(relaxedHeader(sig[:i]), "\r\n")
+			hash := sha256.Sum256([]byte(signed))
+			if !tc.verify(hash[:], b) {
+				t.Error("got invalid signature; want valid signature")
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpError is an error that happens when a delivery service responds with an unsuccessful HTTP status.
+type httpError struct {
+	code int
+	body string
+	// retryAfter is a delay that a delivery service requested in the header Retry-After.
+	retryAfter time.Duration
+}
+
+func (e *httpError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("unexpected HTTP status %d", e.code)
+	}
+	return fmt.Sprintf("unexpected HTTP status %d: %s", e.code, e.body)
+}
+
+// Temporary returns true when a delivery service may accept the same request later.
+func (e *httpError) Temporary() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
+
+// httpErrorBodyMaxLen is a maximum length of a response body that is included into httpError.
+const httpErrorBodyMaxLen = 512
+
+// postJSON sends a value encoded to JSON by HTTP POST to a URL.
+// If out is not nil, the function decodes a response body into it.
+func postJSON(client *http.Client, url string, in, out interface{}) error {
+	req, err := newJSONRequest(http.MethodPost, url, in)
+	if err != nil {
+		return err
+	}
+	return doHTTP(client, req, out)
+}
+
+// newJSONRequest returns an HTTP request with a body that contains a value encoded to JSON.
+func newJSONRequest(method, url string, in interface{}) (*http.Request, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode request")
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// doHTTP sends an HTTP request and checks that a response has a successful status.
+// If out is not nil, the function decodes a JSON response body into it.
+func doHTTP(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, httpErrorBodyMaxLen))
+		return &httpError{
+			code:       resp.StatusCode,
+			body:       strings.TrimSpace(string(b)),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrap(err, "failed to decode response")
+	}
+	return nil
+}
+
+// hideURL returns an error of an HTTP client without the request's URL.
+// Webhook URLs and API endpoints contain secrets, so they must not leak to logs.
+func hideURL(err error) error {
+	if v, ok := err.(*url.Error); ok {
+		return v.Err
+	}
+	return err
+}
+
+// parseRetryAfter parses a value of the header Retry-After that contains seconds or an HTTP date.
+// The function returns zero if the value is empty or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
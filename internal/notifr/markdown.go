@@ -0,0 +1,228 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"fmt"
+	"strings"
+
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+// parseMarkdown parses a Markdown text with the same extensions that blackfriday.Run uses to render emails.
+func parseMarkdown(text string) *blackfriday.Node {
+	return blackfriday.New(blackfriday.WithExtensions(blackfriday.CommonExtensions)).Parse([]byte(text))
+}
+
+// textRenderer renders a Markdown document to a lightweight markup that is supported by a messenger.
+// Every field describes how the corresponding Markdown element looks in the target markup.
+// The functions code and codeBlock receive a raw code, and they are responsible for escaping it.
+type textRenderer struct {
+	escape    func(s string) string
+	emph      [2]string
+	strong    [2]string
+	del       [2]string
+	code      func(code string) string
+	codeBlock func(lang, code string) string
+	link      func(dest, text string) string
+	quote     func(blocks []string) string
+	hr        string
+	bullet    string
+}
+
+// render converts a Markdown text to the markup.
+func (r *textRenderer) render(text string) string {
+	return strings.Join(r.renderBlocks(text), "\n\n")
+}
+
+// renderBlocks converts a Markdown text to the markup and returns the top-level blocks of the text separately.
+func (r *textRenderer) renderBlocks(text string) []string {
+	return r.blocks(parseMarkdown(text))
+}
+
+func (r *textRenderer) blocks(node *blackfriday.Node) []string {
+	var ss []string
+	for child := node.FirstChild; child != nil; child = child.Next {
+		if s := strings.TrimSpace(r.block(child)); s != "" {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+func (r *textRenderer) block(node *blackfriday.Node) string {
+	switch node.Type {
+	case blackfriday.Paragraph:
+		return r.inlines(node)
+	case blackfriday.Heading:
+		return r.strong[0] + r.inlines(node) + r.strong[1]
+	case blackfriday.BlockQuote:
+		return r.quote(r.blocks(node))
+	case blackfriday.List:
+		sep := "\n"
+		if !node.Tight {
+			sep = "\n\n"
+		}
+		var items []string
+		n := 1
+		for item := node.FirstChild; item != nil; item = item.Next {
+			marker := r.bullet
+			if node.ListFlags&blackfriday.ListTypeOrdered != 0 {
+				marker = fmt.Sprintf("%d. ", n)
+			}
+			n++
+			items = append(items, prefixLines(strings.Join(r.blocks(item), sep), marker, strings.Repeat(" ", len([]rune(marker)))))
+		}
+		return strings.Join(items, sep)
+	case blackfriday.CodeBlock:
+		return r.codeBlock(string(node.Info), strings.TrimRight(string(node.Literal), "\n"))
+	case blackfriday.HorizontalRule:
+		return r.hr
+	case blackfriday.HTMLBlock:
+		return r.escape(strings.TrimSpace(string(node.Literal)))
+	case blackfriday.Table:
+		var rows []string
+		node.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+			if n.Type != blackfriday.TableRow || !entering {
+				return blackfriday.GoToNext
+			}
+			var cells []string
+			for cell := n.FirstChild; cell != nil; cell = cell.Next {
+				text := r.inlines(cell)
+				if cell.IsHeader {
+					text = r.strong[0] + text + r.strong[1]
+				}
+				cells = append(cells, text)
+			}
+			rows = append(rows, strings.Join(cells, " | "))
+			return blackfriday.SkipChildren
+		})
+		return strings.Join(rows, "\n")
+	}
+	return r.inlines(node)
+}
+
+func (r *textRenderer) inlines(node *blackfriday.Node) string {
+	var sb strings.Builder
+	for child := node.FirstChild; child != nil; child = child.Next {
+		switch child.Type {
+		case blackfriday.Text, blackfriday.HTMLSpan:
+			sb.WriteString(r.escape(string(child.Literal)))
+		case blackfriday.Emph:
+			sb.WriteString(r.emph[0] + r.inlines(child) + r.emph[1])
+		case blackfriday.Strong:
+			sb.WriteString(r.strong[0] + r.inlines(child) + r.strong[1])
+		case blackfriday.Del:
+			sb.WriteString(r.del[0] + r.inlines(child) + r.del[1])
+		case blackfriday.Code:
+			sb.WriteString(r.code(string(child.Literal)))
+		case blackfriday.Link, blackfriday.Image:
+			sb.WriteString(r.link(string(child.Destination), r.inlines(child)))
+		case blackfriday.Softbreak, blackfriday.Hardbreak:
+			sb.WriteString("\n")
+		default:
+			sb.WriteString(r.inlines(child))
+		}
+	}
+	return sb.String()
+}
+
+// truncateText cuts a text to max characters.
+func truncateText(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max])
+}
+
+// splitText splits a text to chunks that contain no more than max characters.
+// The function prefers to split a text on line breaks so that a formatted line is not broken between two chunks.
+func splitText(s string, max int) []string {
+	var chunks []string
+	r := []rune(s)
+	for len(r) > max {
+		n := max
+		for i := max; i > 0; i-- {
+			if r[i] == '\n' {
+				n = i
+				break
+			}
+		}
+		if chunk := strings.TrimSpace(string(r[:n])); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		r = r[n:]
+		for len(r) > 0 && r[0] == '\n' {
+			r = r[1:]
+		}
+	}
+	if chunk := strings.TrimSpace(string(r)); chunk != "" {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// joinChunks joins blocks with a separator into chunks that contain no more than max characters.
+// A block that is longer than max is split by the split function.
+func joinChunks(blocks []string, sep string, max int, split func(block string) []string) []string {
+	var (
+		chunks []string
+		cur    string
+	)
+	for _, block := range blocks {
+		parts := []string{block}
+		if len([]rune(block)) > max {
+			parts = split(block)
+		}
+		for _, part := range parts {
+			switch {
+			case cur == "":
+				cur = part
+			case len([]rune(cur))+len([]rune(sep))+len([]rune(part)) <= max:
+				cur += sep + part
+			default:
+				chunks = append(chunks, cur)
+				cur = part
+			}
+		}
+	}
+	if cur != "" {
+		chunks = append(chunks, cur)
+	}
+	return chunks
+}
+
+// prefixLines adds a prefix to the first line of a text and an indent to the other lines.
+func prefixLines(s, prefix, indent string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			lines[i] = prefix + line
+		case line != "":
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// plainTextRenderer renders Markdown to plain text for deliveries that do not support any markup.
+var plainTextRenderer = &textRenderer{
+	escape:    func(s string) string { return s },
+	code:      func(code string) string { return code },
+	codeBlock: func(lang, code string) string { return code },
+	link: func(dest, text string) string {
+		if text == "" || text == dest {
+			return dest
+		}
+		return text + " (" + dest + ")"
+	},
+	quote:  func(blocks []string) string { return prefixLines(strings.Join(blocks, "\n"), "> ", "> ") },
+	bullet: "- ",
+}
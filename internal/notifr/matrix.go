@@ -0,0 +1,130 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+// MatrixConfig is configuration for Matrix Client-Server API.
+type MatrixConfig struct {
+	Homeserver  string          `envconfig:"homeserver" desc:"a base URL of a Matrix homeserver (e.g. https://matrix.example.org)"`
+	AccessToken string          `envconfig:"access_token" json:"-" desc:"an access token of a Matrix user; the delivery is disabled when the token is empty"`
+	Timeout     time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to a Matrix homeserver"`
+	Retries     []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// MatrixSender is a message sender that sends a message to Matrix rooms.
+// Recipients of the delivery are room IDs (!room:example.org) or room aliases (#room:example.org).
+// The user of the access token must be a member of the rooms.
+type MatrixSender struct {
+	MatrixConfig
+	client *http.Client
+}
+
+// NewMatrixSender returns a new MatrixSender.
+func NewMatrixSender(cnf MatrixConfig) *MatrixSender {
+	return &MatrixSender{
+		MatrixConfig: cnf,
+		client:       &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// matrixMessage is a content of the event m.room.message (https://spec.matrix.org/latest/client-server-api/#mroommessage).
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+// Send sends a message to Matrix rooms.
+// A message is sent as a notice, so that bots in a room do not react on it.
+//
+// Every message has a transaction ID that does not change between retries,
+// so a homeserver ignores a retry of a message that it has already received.
+func (s *MatrixSender) Send(recipients []string, msg Message) error {
+	mm := newMatrixMessage(msg)
+	return sendEach(recipients, msg, func(room string) error {
+		txnID, err := newTxnID()
+		if err != nil {
+			return err
+		}
+		return retry(s.Retries, func() error {
+			roomID, err := s.resolveRoom(room)
+			if err != nil {
+				return errors.Wrap(err, "failed to resolve room alias")
+			}
+			endpoint := fmt.Sprintf("%s/rooms/%s/send/m.room.message/%s", s.apiURL(), url.PathEscape(roomID), txnID)
+			req, err := newJSONRequest(http.MethodPut, endpoint, mm)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+s.AccessToken)
+			return doHTTP(s.client, req, nil)
+		})
+	})
+}
+
+// resolveRoom returns a room ID by a room alias. If a room is a room ID already, the method returns it as is.
+func (s *MatrixSender) resolveRoom(room string) (string, error) {
+	if !strings.HasPrefix(room, "#") {
+		return room, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, s.apiURL()+"/directory/room/"+url.PathEscape(room), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.AccessToken)
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	if err = doHTTP(s.client, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+func (s *MatrixSender) apiURL() string {
+	return strings.TrimRight(s.Homeserver, "/") + "/_matrix/client/v3"
+}
+
+// newMatrixMessage converts a message to a content of a Matrix event.
+// The body is plain text for clients without HTML support, and the formatted body is HTML; both are rendered from Markdown.
+func newMatrixMessage(msg Message) *matrixMessage {
+	body, formatted := plainTextRenderer.render(msg.Text), string(blackfriday.Run([]byte(msg.Text)))
+	if msg.Subject != "" {
+		body = msg.Subject + "\n\n" + body
+		formatted = "<h3>" + html.EscapeString(msg.Subject) + "</h3>\n" + formatted
+	}
+	return &matrixMessage{
+		MsgType:       "m.notice",
+		Body:          body,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.TrimSpace(formatted),
+	}
+}
+
+// newTxnID returns a new random transaction ID.
+func newTxnID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate transaction ID")
+	}
+	return "notifr-" + hex.EncodeToString(b), nil
+}
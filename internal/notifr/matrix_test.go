@@ -0,0 +1,75 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewMatrixMessage(t *testing.T) {
+	got := newMatrixMessage(Message{Subject: "Alert <db1>", Text: "**Disk** is full"})
+	want := &matrixMessage{
+		MsgType:       "m.notice",
+		Body:          "Alert <db1>\n\nDisk is full",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: "<h3>Alert &lt;db1&gt;</h3>\n<p><strong>Disk</strong> is full</p>",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got message: %+v; want message: %+v", got, want)
+	}
+}
+
+func TestMatrixSender(t *testing.T) {
+	var (
+		txnIDs []string
+		sent   []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/_matrix/client/v3/directory/room/#ops:example.org":
+			w.Write([]byte(`{"room_id": "!ops:example.org"}`))
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/!ops:example.org/send/m.room.message/"):
+			var mm matrixMessage
+			if err := json.NewDecoder(r.Body).Decode(&mm); err != nil {
+				t.Errorf("failed to decode event: %s", err)
+			}
+			txnIDs = append(txnIDs, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+			// The first request fails to check that the retry has the same transaction ID.
+			if len(txnIDs) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			sent = append(sent, mm.Body)
+			w.Write([]byte(`{"event_id": "$event"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	sender := NewMatrixSender(MatrixConfig{Homeserver: srv.URL + "/", AccessToken: "test-token", Retries: []time.Duration{0, 0}})
+	if err := sender.Send([]string{"#ops:example.org"}, Message{Text: "Test"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if len(txnIDs) != 2 || txnIDs[0] != txnIDs[1] {
+		t.Errorf("got transaction IDs: %q; want two equal transaction IDs", txnIDs)
+	}
+	if !reflect.DeepEqual(sent, []string{"Test"}) {
+		t.Errorf("got sent messages: %q; want sent messages: %q", sent, []string{"Test"})
+	}
+}
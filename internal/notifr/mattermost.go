@@ -0,0 +1,191 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MattermostConfig is configuration for Mattermost incoming webhooks.
+type MattermostConfig struct {
+	Timeout time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Mattermost"`
+	Retries []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// MattermostSender is a message sender that sends a message to Mattermost incoming webhooks.
+// Recipients of the delivery are webhook URLs with optional overrides (see parseChatWebhook).
+type MattermostSender struct {
+	MattermostConfig
+	client *http.Client
+}
+
+// NewMattermostSender returns a new MattermostSender.
+func NewMattermostSender(cnf MattermostConfig) *MattermostSender {
+	return &MattermostSender{
+		MattermostConfig: cnf,
+		client:           &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// mattermostMessageMaxLen is a maximum length of a Mattermost post.
+const mattermostMessageMaxLen = 16383
+
+// mattermostMessage is a payload of Mattermost incoming webhooks (https://developers.mattermost.com/integrate/webhooks/incoming/).
+type mattermostMessage struct {
+	Text      string `json:"text"`
+	Channel   string `json:"channel,omitempty"`
+	Username  string `json:"username,omitempty"`
+	IconURL   string `json:"icon_url,omitempty"`
+	IconEmoji string `json:"icon_emoji,omitempty"`
+}
+
+// Send sends a message to Mattermost incoming webhooks.
+// The method tries to re-send a message when the previous sending failed with a temporary error.
+func (s *MattermostSender) Send(recipients []string, msg Message) error {
+	text := sanitizeChatMarkdown(msg.Text)
+	if msg.Subject != "" {
+		text = "#### " + sanitizeChatMarkdown(msg.Subject) + "\n\n" + text
+	}
+	chunks := splitText(text, mattermostMessageMaxLen)
+	return sendEach(recipients, msg, func(rcpt string) error {
+		hook, err := parseChatWebhook(rcpt)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			mm := &mattermostMessage{Text: chunk, Channel: hook.channel, Username: hook.username}
+			if strings.HasPrefix(hook.icon, ":") {
+				mm.IconEmoji = strings.Trim(hook.icon, ":")
+			} else {
+				mm.IconURL = hook.icon
+			}
+			if err = retry(s.Retries, func() error { return hideURL(postJSON(s.client, hook.url, mm, nil)) }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RocketChatConfig is configuration for Rocket.Chat incoming webhooks.
+type RocketChatConfig struct {
+	Timeout time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Rocket.Chat"`
+	Retries []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// RocketChatSender is a message sender that sends a message to Rocket.Chat incoming webhooks.
+// Recipients of the delivery are webhook URLs with optional overrides (see parseChatWebhook).
+type RocketChatSender struct {
+	RocketChatConfig
+	client *http.Client
+}
+
+// NewRocketChatSender returns a new RocketChatSender.
+func NewRocketChatSender(cnf RocketChatConfig) *RocketChatSender {
+	return &RocketChatSender{
+		RocketChatConfig: cnf,
+		client:           &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// rocketChatMessageMaxLen is a default maximum length of a Rocket.Chat message.
+const rocketChatMessageMaxLen = 5000
+
+// rocketChatMessage is a payload of Rocket.Chat incoming webhooks (https://docs.rocket.chat/use-rocket.chat/workspace-administration/integrations).
+type rocketChatMessage struct {
+	Text    string `json:"text"`
+	Channel string `json:"channel,omitempty"`
+	Alias   string `json:"alias,omitempty"`
+	Avatar  string `json:"avatar,omitempty"`
+	Emoji   string `json:"emoji,omitempty"`
+}
+
+// Send sends a message to Rocket.Chat incoming webhooks.
+// The method tries to re-send a message when the previous sending failed with a temporary error.
+func (s *RocketChatSender) Send(recipients []string, msg Message) error {
+	text := sanitizeChatMarkdown(msg.Text)
+	if msg.Subject != "" {
+		text = "*" + sanitizeChatMarkdown(msg.Subject) + "*\n\n" + text
+	}
+	chunks := splitText(text, rocketChatMessageMaxLen)
+	return sendEach(recipients, msg, func(rcpt string) error {
+		hook, err := parseChatWebhook(rcpt)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			rm := &rocketChatMessage{Text: chunk, Channel: hook.channel, Alias: hook.username}
+			if strings.HasPrefix(hook.icon, ":") {
+				rm.Emoji = hook.icon
+			} else {
+				rm.Avatar = hook.icon
+			}
+			if err = retry(s.Retries, func() error { return hideURL(postJSON(s.client, hook.url, rm, nil)) }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// chatWebhook is an incoming webhook of a self-hosted chat with overrides of a message's appearance.
+type chatWebhook struct {
+	url      string
+	channel  string
+	username string
+	icon     string
+}
+
+// parseChatWebhook parses a recipient of a self-hosted chat delivery.
+// A recipient is a webhook URL, and overrides are specified in the URL's fragment,
+// e.g. "https://chat.example.org/hooks/xxx#channel=ops&username=notifr&icon=:bell:".
+// The icon is an emoji when it is enclosed in colons, and an image URL otherwise.
+func parseChatWebhook(rcpt string) (*chatWebhook, error) {
+	u, err := url.Parse(rcpt)
+	if err != nil {
+		return nil, hideURL(err)
+	}
+	opts, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	for k := range opts {
+		if k != "channel" && k != "username" && k != "icon" {
+			return nil, fmt.Errorf("unknown webhook override %q", k)
+		}
+	}
+	u.Fragment = ""
+	return &chatWebhook{
+		url:      u.String(),
+		channel:  opts.Get("channel"),
+		username: opts.Get("username"),
+		icon:     opts.Get("icon"),
+	}, nil
+}
+
+// reChatMention matches mentions that notify all members of a channel.
+var reChatMention = regexp.MustCompile(`(^|[^\w])@(all|channel|here)\b`)
+
+// sanitizeChatMarkdown prepares a Markdown text for a chat that renders Markdown natively.
+// The function removes control characters, and breaks mentions of all channel's members,
+// so that a notification cannot wake up a whole channel accidentally.
+func sanitizeChatMarkdown(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if (r < 0x20 && r != '\n' && r != '\t') || r == 0x7f {
+			return -1
+		}
+		return r
+	}, text)
+	// A zero-width space after "@" keeps a mention readable but disables it.
+	return reChatMention.ReplaceAllString(text, "$1@\u200b$2")
+}
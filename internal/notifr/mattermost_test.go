@@ -0,0 +1,117 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseChatWebhook(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rcpt    string
+		want    *chatWebhook
+		wantErr bool
+	}{
+		{
+			name: "without overrides",
+			rcpt: "https://chat.example.org/hooks/xxx",
+			want: &chatWebhook{url: "https://chat.example.org/hooks/xxx"},
+		},
+		{
+			name: "with overrides",
+			rcpt: "https://chat.example.org/hooks/xxx#channel=#ops&username=notifr&icon=:bell:",
+			want: &chatWebhook{url: "https://chat.example.org/hooks/xxx", channel: "#ops", username: "notifr", icon: ":bell:"},
+		},
+		{
+			name:    "unknown override",
+			rcpt:    "https://chat.example.org/hooks/xxx#color=red",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseChatWebhook(tc.rcpt)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got webhook: %+v; want webhook: %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeChatMarkdown(t *testing.T) {
+	got := sanitizeChatMarkdown("@all **disk** is full\x07, ping @here and admin@channel.org")
+	want := "@\u200ball **disk** is full, ping @\u200bhere and admin@channel.org"
+	if got != want {
+		t.Errorf("got text: %q; want text: %q", got, want)
+	}
+}
+
+func TestSelfHostedChatSenders(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode payload: %s", err)
+		}
+	}))
+	defer srv.Close()
+
+	testCases := []struct {
+		name   string
+		sender Sender
+		rcpt   string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "mattermost",
+			sender: NewMattermostSender(MattermostConfig{Retries: []time.Duration{0}}),
+			rcpt:   srv.URL + "#channel=ops&username=notifr&icon=:bell:",
+			want: map[string]interface{}{
+				"text":       "#### Alert\n\n**Disk** is full",
+				"channel":    "ops",
+				"username":   "notifr",
+				"icon_emoji": "bell",
+			},
+		},
+		{
+			name:   "rocketchat",
+			sender: NewRocketChatSender(RocketChatConfig{Retries: []time.Duration{0}}),
+			rcpt:   srv.URL + "#channel=#ops&icon=https://example.org/bot.png",
+			want: map[string]interface{}{
+				"text":    "*Alert*\n\n**Disk** is full",
+				"channel": "#ops",
+				"avatar":  "https://example.org/bot.png",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.sender.Send([]string{tc.rcpt}, Message{Subject: "Alert", Text: "**Disk** is full"}); err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got payload: %v; want payload: %v", got, tc.want)
+			}
+		})
+	}
+}
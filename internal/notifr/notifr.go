@@ -8,12 +8,20 @@ LICENSE file in the root directory of this source tree.
 package notifr
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/i-core/rlog"
 	"github.com/pkg/errors"
@@ -53,6 +61,22 @@ const (
 	errKindUnsupportedDelivery valErrKind = "unsupported delivery type"
 	// An error that happens when an email in a target config is invalid.
 	errKindInvalidEmail valErrKind = "invalid email"
+	// An error that happens when a URL in a target config is invalid.
+	errKindInvalidURL valErrKind = "invalid URL"
+	// An error that happens when a Telegram chat ID in a target config is invalid.
+	errKindInvalidChatID valErrKind = "invalid chat ID"
+	// An error that happens when a recipient in a target config is not defined in the delivery's configuration.
+	errKindUnknownRecipient valErrKind = "unknown recipient"
+	// An error that happens when a Matrix room in a target config is invalid.
+	errKindInvalidRoom valErrKind = "invalid room"
+	// An error that happens when a phone number in a target config is not in the E.164 format.
+	errKindInvalidPhone valErrKind = "invalid phone number"
+	// An error that happens when an ntfy topic in a target config is invalid.
+	errKindInvalidTopic valErrKind = "invalid topic"
+	// An error that happens when a Pushover user key in a target config is invalid.
+	errKindInvalidUserKey valErrKind = "invalid user key"
+	// An error that happens when an address of a syslog server in a target config is invalid.
+	errKindInvalidAddress valErrKind = "invalid address"
 )
 
 func (e *valError) Error() string {
@@ -65,6 +89,7 @@ func (e *valError) Error() string {
 }
 
 // Decode decodes a string in the format "target1:delivery1:recipient1,target2:delivery2:recipient2" to TargetsConfig.
+// A recipient can contain colons, for example, when it is a webhook URL.
 func (cnf *TargetsConfig) Decode(value string) error {
 	if value == "" {
 		return nil
@@ -75,7 +100,7 @@ func (cnf *TargetsConfig) Decode(value string) error {
 
 	// Configuration of the targets is divided into a target, delivery, recipient for TargetConfig filling.
 	for _, v := range strings.Split(value, ",") {
-		elem := strings.Split(v, ":")
+		elem := strings.SplitN(v, ":", 3)
 		if len(elem) != 3 {
 			return &valError{kind: errKindInvTargetSyntax, target: v}
 		}
@@ -108,13 +133,13 @@ func (cnf *TargetsConfig) Decode(value string) error {
 }
 
 // MarshalJSON serializes TargetsConfig to a string in the format "target1:delivery1:recipient1,target2:delivery2:recipient2".
-// It is needed for the correct output in logs.
+// It is needed for the correct output in logs, so webhook URLs are redacted.
 func (cnf TargetsConfig) MarshalJSON() ([]byte, error) {
 	var vv []string
 	for targetName, target := range cnf.targets {
 		for _, delivery := range target.deliveries {
 			for _, recipient := range delivery.recipients {
-				vv = append(vv, fmt.Sprintf("%s:%s:%s", targetName, delivery.name, recipient))
+				vv = append(vv, fmt.Sprintf("%s:%s:%s", targetName, delivery.name, redactRecipient(recipient)))
 			}
 		}
 	}
@@ -124,61 +149,238 @@ func (cnf TargetsConfig) MarshalJSON() ([]byte, error) {
 
 var reEmail = regexp.MustCompile("[a-z0-9!#$%&'*+/=?^_`{|}~-]+(?:\\.[a-z0-9!#$%&'*+/=?^_`{|}~-]+)*@(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\\.)+[a-z0-9](?:[a-z0-9-]*[a-z0-9])?")
 
+// reTelegramChatID matches a numeric chat ID or a channel username (https://core.telegram.org/bots/api#sendmessage).
+var reTelegramChatID = regexp.MustCompile(`^(-?[0-9]+|@[a-zA-Z][a-zA-Z0-9_]{4,31})$`)
+
+// reMatrixRoom matches a Matrix room ID or a room alias (https://spec.matrix.org/latest/appendices/#room-ids).
+var reMatrixRoom = regexp.MustCompile(`^[!#][^:\s]+:\S+$`)
+
+// rePhone matches a phone number in the E.164 format.
+var rePhone = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// reNtfyTopic matches an ntfy topic name.
+var reNtfyTopic = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// rePushoverKey matches a Pushover user or group key.
+var rePushoverKey = regexp.MustCompile(`^[a-zA-Z0-9]{30}$`)
+
+// isHTTPURL returns true if a string is an absolute HTTP or HTTPS URL.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// redactRecipient hides a recipient's secrets for logs. Webhook URLs contain tokens in their paths,
+// so only the scheme and the host of a URL are kept, e.g. "https://hooks.slack.com/…". Other recipients are returned as is.
+func redactRecipient(rcpt string) string {
+	if !isHTTPURL(rcpt) {
+		return rcpt
+	}
+	u, _ := url.Parse(rcpt)
+	return u.Scheme + "://" + u.Host + "/…"
+}
+
 // DeliveryType is a delivery type.
 type DeliveryType string
 
-// DeliverySMTP is an SMTP delivery type.
-const DeliverySMTP DeliveryType = "smtp"
+const (
+	// DeliverySMTP is an SMTP delivery type.
+	DeliverySMTP DeliveryType = "smtp"
+	// DeliverySlack is a Slack incoming webhook delivery type.
+	DeliverySlack DeliveryType = "slack"
+	// DeliveryTelegram is a Telegram Bot API delivery type.
+	DeliveryTelegram DeliveryType = "telegram"
+	// DeliveryWebhook is an outgoing HTTP webhook delivery type.
+	DeliveryWebhook DeliveryType = "webhook"
+	// DeliveryTeams is a Microsoft Teams webhook delivery type.
+	DeliveryTeams DeliveryType = "teams"
+	// DeliveryMattermost is a Mattermost incoming webhook delivery type.
+	DeliveryMattermost DeliveryType = "mattermost"
+	// DeliveryRocketChat is a Rocket.Chat incoming webhook delivery type.
+	DeliveryRocketChat DeliveryType = "rocketchat"
+	// DeliveryDiscord is a Discord webhook delivery type.
+	DeliveryDiscord DeliveryType = "discord"
+	// DeliveryMatrix is a Matrix Client-Server API delivery type.
+	DeliveryMatrix DeliveryType = "matrix"
+	// DeliverySMS is an HTTP SMS gateway delivery type.
+	DeliverySMS DeliveryType = "sms"
+	// DeliveryNtfy is an ntfy push notification delivery type.
+	DeliveryNtfy DeliveryType = "ntfy"
+	// DeliveryGotify is a Gotify push notification delivery type.
+	DeliveryGotify DeliveryType = "gotify"
+	// DeliveryPushover is a Pushover push notification delivery type.
+	DeliveryPushover DeliveryType = "pushover"
+	// DeliverySyslog is a syslog delivery type.
+	DeliverySyslog DeliveryType = "syslog"
+)
 
 // Sender is an interface to send a message to a delivery service.
 type Sender interface {
 	Send(recipients []string, msg Message) error
 }
 
+// retry calls fn until it succeeds or fails with an error that is not temporary.
+// The function waits for the next interval after every failed attempt, so the number of attempts equals the number of intervals.
+func retry(intervals []time.Duration, fn func() error) error {
+	var err error
+	for _, n := range intervals {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !isTemporary(err) {
+			return err
+		}
+		time.Sleep(n)
+	}
+	return err
+}
+
+// isTemporary returns true if an error is temporary, e.g. a network timeout or an HTTP status 503.
+func isTemporary(err error) bool {
+	v, ok := errors.Cause(err).(interface{ Temporary() bool })
+	return ok && v.Temporary()
+}
+
+// sendErrors is an error that happens when a message is not sent to some recipients of a delivery.
+type sendErrors []error
+
+func (e sendErrors) Error() string {
+	ss := make([]string, 0, len(e))
+	for _, err := range e {
+		ss = append(ss, err.Error())
+	}
+	return strings.Join(ss, "; ")
+}
+
+// sendEach calls send for every recipient of a message and returns the errors of all failed recipients.
+// The recipients that the message is sent to are reported to the message's progress callback.
+func sendEach(recipients []string, msg Message, send func(rcpt string) error) error {
+	var errs sendErrors
+	for _, rcpt := range recipients {
+		if err := send(rcpt); err != nil {
+			errs = append(errs, errors.Wrapf(err, "recipient %q", redactRecipient(rcpt)))
+			continue
+		}
+		if msg.sent != nil {
+			msg.sent(rcpt)
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// LimitsConfig is configuration for limits of incoming requests.
+type LimitsConfig struct {
+	MaxRequestSize    int64 `envconfig:"max_request_size" default:"33554432" desc:"a maximum size of a request body in bytes; larger requests are rejected with 413 (0 means unlimited)"`
+	MaxAttachmentSize int64 `envconfig:"max_attachment_size" default:"10485760" desc:"a maximum size of an attachment in bytes; requests with larger attachments are rejected with 413 (0 means unlimited)"`
+}
+
 // Handler is an HTTP handler that receives messages over HTTP and sends them to configured deliveries.
 type Handler struct {
 	senders map[DeliveryType]Sender
 	targets TargetsConfig
+	limits  LimitsConfig
+	// queue is a queue of messages that are delivered asynchronously. It is nil if messages are delivered synchronously.
+	queue *messageQueue
 }
 
 // NewHandler returns a new instance of Handler.
-func NewHandler(targets TargetsConfig, senders map[DeliveryType]Sender) (*Handler, error) {
-	var supportedDeliveries []DeliveryType
-	for v := range senders {
-		supportedDeliveries = append(supportedDeliveries, v)
-	}
-	if err := validateTargetConfig(supportedDeliveries, targets); err != nil {
+// If asynchronous delivery is enabled, the handler starts background workers that deliver messages.
+func NewHandler(targets TargetsConfig, senders map[DeliveryType]Sender, limits LimitsConfig, async AsyncConfig) (*Handler, error) {
+	if err := validateTargetConfig(senders, targets); err != nil {
 		return nil, errors.Wrap(err, "invalid target configuration")
 	}
-	return &Handler{senders: senders, targets: targets}, nil
+	h := &Handler{senders: senders, targets: targets, limits: limits}
+	if async.Enabled {
+		q, err := newMessageQueue(async, targets, senders)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid asynchronous delivery configuration")
+		}
+		h.queue = q
+	}
+	return h, nil
+}
+
+// Resume delivers the messages that were accepted but not delivered before a restart.
+// It does nothing unless asynchronous delivery with a queue directory is enabled.
+func (srv *Handler) Resume(log *zap.Logger) {
+	if srv.queue != nil {
+		srv.queue.resume(log)
+	}
+}
+
+// Close stops accepting messages for asynchronous delivery and waits until the queued messages are delivered
+// or the context is done. It does nothing unless asynchronous delivery is enabled.
+func (srv *Handler) Close(ctx context.Context) error {
+	if srv.queue == nil {
+		return nil
+	}
+	return srv.queue.close(ctx)
+}
+
+// recipientValidator is an interface of a sender which recipients are defined in the sender's configuration.
+type recipientValidator interface {
+	hasRecipient(rcpt string) bool
 }
 
 // validateTargetConfig checks that TargetsConfig contains supported deliveries and valid recipients.
-func validateTargetConfig(supportedDeliveries []DeliveryType, cnf TargetsConfig) error {
+func validateTargetConfig(senders map[DeliveryType]Sender, cnf TargetsConfig) error {
 	if len(cnf.targets) == 0 {
 		return &valError{kind: errKindEmptyTargets}
 	}
 	for targetName, target := range cnf.targets {
 		for _, delivery := range target.deliveries {
 			for _, recipient := range delivery.recipients {
-				var deliverySupported bool
 				// Validate that deliveries are supported.
 				// We validate deliveries in the recipient's loop to format errors as `"target:delivery:recipient": cause`.
 				// It is easier for a user to read errors in this format.
-				for _, v := range supportedDeliveries {
-					if delivery.name == v {
-						deliverySupported = true
-						break
-					}
-				}
+				sender, deliverySupported := senders[delivery.name]
 				targetString := fmt.Sprintf("%s:%s:%s", targetName, delivery.name, recipient)
 				if !deliverySupported {
 					return &valError{kind: errKindUnsupportedDelivery, target: targetString}
 				}
-				if delivery.name == DeliverySMTP {
+				switch delivery.name {
+				case DeliverySMTP:
 					if !reEmail.MatchString(recipient) {
 						return &valError{kind: errKindInvalidEmail, target: targetString}
 					}
+				case DeliverySlack, DeliveryTeams, DeliveryDiscord:
+					if !isHTTPURL(recipient) {
+						return &valError{kind: errKindInvalidURL, target: targetString}
+					}
+				case DeliveryMattermost, DeliveryRocketChat:
+					if _, err := parseChatWebhook(recipient); err != nil || !isHTTPURL(recipient) {
+						return &valError{kind: errKindInvalidURL, target: targetString}
+					}
+				case DeliveryMatrix:
+					if !reMatrixRoom.MatchString(recipient) {
+						return &valError{kind: errKindInvalidRoom, target: targetString}
+					}
+				case DeliverySMS:
+					if !rePhone.MatchString(recipient) {
+						return &valError{kind: errKindInvalidPhone, target: targetString}
+					}
+				case DeliveryNtfy:
+					if !reNtfyTopic.MatchString(recipient) {
+						return &valError{kind: errKindInvalidTopic, target: targetString}
+					}
+				case DeliveryPushover:
+					if !rePushoverKey.MatchString(recipient) {
+						return &valError{kind: errKindInvalidUserKey, target: targetString}
+					}
+				case DeliverySyslog:
+					if _, _, err := parseSyslogAddr(recipient); err != nil {
+						return &valError{kind: errKindInvalidAddress, target: targetString}
+					}
+				case DeliveryTelegram:
+					if !reTelegramChatID.MatchString(recipient) {
+						return &valError{kind: errKindInvalidChatID, target: targetString}
+					}
+				}
+				if v, ok := sender.(recipientValidator); ok && !v.hasRecipient(recipient) {
+					return &valError{kind: errKindUnknownRecipient, target: targetString}
 				}
 			}
 		}
@@ -188,19 +390,185 @@ func validateTargetConfig(supportedDeliveries []DeliveryType, cnf TargetsConfig)
 
 // AddRoutes registers all required routes for the package notifr.
 func (srv *Handler) AddRoutes(apply func(m, p string, h http.Handler, mws ...func(http.Handler) http.Handler)) {
-	apply(http.MethodPost, "", newMessageHandler(srv.targets, srv.senders))
+	apply(http.MethodPost, "", newMessageHandler(srv.targets, srv.senders, srv.limits, srv.queue))
 }
 
 // Message is a message received in an HTTP request for transferring to delivery service.
 type Message struct {
 	Subject string `json:"subject"`
 	Text    string `json:"text"`
+	// Severity is an optional severity of a message: critical, error, warning, info, ok or resolved.
+	// Deliveries use it to pick a color or a priority of a message.
+	Severity string `json:"severity,omitempty"`
+	// Target is a name of the target of a message. It is filled by the handler from the request's query.
+	Target string `json:"-"`
+	// Attachments are files that are attached to emails. Other deliveries ignore them.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// ReplyTo, Cc, Headers and Priority are optional fields of emails. Other deliveries ignore them.
+	ReplyTo string   `json:"reply_to,omitempty"`
+	Cc      []string `json:"cc,omitempty"`
+	// Headers are custom header fields of an email. Only the header fields that are allowed in the SMTP configuration are set.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Priority is an optional priority of an email: high, normal or low.
+	Priority string `json:"priority,omitempty"`
+	// Thread is an optional key of a thread, e.g. an incident's ID. Emails with the same thread key are grouped by mail clients.
+	// Other deliveries ignore it.
+	Thread string `json:"thread,omitempty"`
+	// Metadata are arbitrary values that templates of emails and webhook bodies can use, e.g. a link to a dashboard.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// sent is called with every recipient that a message is sent to when a sender sends it to recipients one by one.
+	// It is nil unless the progress of a queued message is stored.
+	sent func(rcpt string)
+}
+
+// Supported priorities of a message.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// reHeaderName is a regular expression for a name of a custom header field.
+var reHeaderName = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// invalidMessageField returns a name of the first message's field that has an invalid value,
+// or an empty string if all the fields are valid.
+func invalidMessageField(msg Message) string {
+	if msg.ReplyTo != "" {
+		if _, err := mail.ParseAddress(msg.ReplyTo); err != nil {
+			return "reply_to"
+		}
+	}
+	for _, addr := range msg.Cc {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return "cc"
+		}
+	}
+	for name, value := range msg.Headers {
+		// Line breaks are not allowed to prevent injecting header fields.
+		if !reHeaderName.MatchString(name) || strings.ContainsAny(value, "\r\n") {
+			return "headers"
+		}
+	}
+	switch msg.Priority {
+	case "", PriorityHigh, PriorityNormal, PriorityLow:
+	default:
+		return "priority"
+	}
+	return ""
+}
+
+// Attachment is a file that is attached to a message.
+// An image attachment is embedded into an email when the message's text refers to it by a link "cid:<filename>".
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+	// Content is the file's content. It is encoded to base64 in JSON.
+	Content []byte `json:"content"`
+}
+
+// errAttachmentTooLarge is returned when an attachment exceeds the configured limit.
+var errAttachmentTooLarge = errors.New("attachment is too large")
+
+// limitedBody is a request body that fails when more than the allowed number of bytes is read from it.
+// Unlike http.MaxBytesReader, it reports whether the limit was exceeded regardless of how a decoder wraps the error.
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errors.New("request body is too large")
+	}
+	// One byte more than allowed is read to detect that the body is larger than the limit.
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.left {
+		b.left -= int64(n)
+		return n, err
+	}
+	n, b.left, b.exceeded = int(b.left), 0, true
+	return n, errors.New("request body is too large")
+}
+
+// multipartMaxMemory is a maximum size of a multipart request that is stored in memory; the rest is stored in temporary files.
+const multipartMaxMemory = 32 << 20
+
+// decodeMultipartMessage decodes a message from a multipart/form-data request.
+// The message's fields are form fields, and every file in the form is an attachment.
+// A custom header field is a form field with the name "headers.<name>", and a metadata value is a form field with the name "metadata.<key>".
+func decodeMultipartMessage(r *http.Request, maxAttachmentSize int64) (Message, error) {
+	if err := r.ParseMultipartForm(multipartMaxMemory); err != nil {
+		return Message{}, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	msg := Message{
+		Subject:  r.FormValue("subject"),
+		Text:     r.FormValue("text"),
+		Severity: r.FormValue("severity"),
+		ReplyTo:  r.FormValue("reply_to"),
+		Cc:       r.MultipartForm.Value["cc"],
+		Priority: r.FormValue("priority"),
+		Thread:   r.FormValue("thread"),
+	}
+	msg.Headers = formMap(r.MultipartForm.Value, "headers.")
+	msg.Metadata = formMap(r.MultipartForm.Value, "metadata.")
+	var fields []string
+	for field := range r.MultipartForm.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, fh := range r.MultipartForm.File[field] {
+			if maxAttachmentSize > 0 && fh.Size > maxAttachmentSize {
+				return Message{}, errAttachmentTooLarge
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return Message{}, err
+			}
+			b, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return Message{}, err
+			}
+			msg.Attachments = append(msg.Attachments, Attachment{
+				Filename:    fh.Filename,
+				ContentType: fh.Header.Get("Content-Type"),
+				Content:     b,
+			})
+		}
+	}
+	return msg, nil
+}
+
+// formMap returns values of form fields with a prefix by the fields' names without the prefix.
+// The function returns nil if there are no such fields.
+func formMap(form map[string][]string, prefix string) map[string]string {
+	var m map[string]string
+	for field, values := range form {
+		if key := strings.TrimPrefix(field, prefix); key != field && len(values) != 0 {
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[key] = values[0]
+		}
+	}
+	return m
 }
 
 // newMessageHandler returns an HTTP handler that forwards a message to delivery services for a specified target.
 // An HTTP request must contain a query parameter "target". A parameter's value is a target's name.
 // An HTTP request must contain a body that is JSON object conforms struct "message".
-func newMessageHandler(targetsConfig TargetsConfig, senders map[DeliveryType]Sender) http.HandlerFunc {
+//
+// If a queue is not nil, the handler adds a message to the queue and responds with the status 202 and the message's ID
+// without waiting for delivery. Otherwise, the handler responds when all deliveries finish.
+func newMessageHandler(targetsConfig TargetsConfig, senders map[DeliveryType]Sender, limits LimitsConfig, queue *messageQueue) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log := rlog.FromContext(r.Context()).Sugar()
 
@@ -226,8 +594,48 @@ func newMessageHandler(targetsConfig TargetsConfig, senders map[DeliveryType]Sen
 			return
 		}
 
-		var msg Message
-		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		if limits.MaxRequestSize > 0 && r.ContentLength > limits.MaxRequestSize {
+			msg := fmt.Sprintln("Request body is too large")
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			log.Debug(msg)
+			return
+		}
+		var body *limitedBody
+		if limits.MaxRequestSize > 0 {
+			body = &limitedBody{ReadCloser: r.Body, left: limits.MaxRequestSize}
+			r.Body = body
+		}
+
+		var (
+			msg Message
+			err error
+		)
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			msg, err = decodeMultipartMessage(r, limits.MaxAttachmentSize)
+		} else {
+			err = json.NewDecoder(r.Body).Decode(&msg)
+		}
+		if body != nil && body.exceeded {
+			msg := fmt.Sprintln("Request body is too large")
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			log.Debug(msg)
+			return
+		}
+		if err == nil && limits.MaxAttachmentSize > 0 {
+			for _, a := range msg.Attachments {
+				if int64(len(a.Content)) > limits.MaxAttachmentSize {
+					err = errAttachmentTooLarge
+					break
+				}
+			}
+		}
+		if err == errAttachmentTooLarge {
+			msg := fmt.Sprintln("Attachment is too large")
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			log.Debug(msg)
+			return
+		}
+		if err != nil {
 			msg := fmt.Sprintln("Invalid body")
 			http.Error(w, msg, http.StatusBadRequest)
 			log.Debugf(msg, zap.Error(err))
@@ -239,19 +647,86 @@ func newMessageHandler(targetsConfig TargetsConfig, senders map[DeliveryType]Sen
 			log.Debug(msg)
 			return
 		}
+		for _, a := range msg.Attachments {
+			if a.Filename == "" {
+				msg := fmt.Sprintln("Missing required fields: attachments.filename")
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Debug(msg)
+				return
+			}
+		}
+		if field := invalidMessageField(msg); field != "" {
+			msg := fmt.Sprintf("Invalid fields: %s\n", field)
+			http.Error(w, msg, http.StatusBadRequest)
+			log.Debug(msg)
+			return
+		}
 
-		var wg sync.WaitGroup
-		wg.Add(len(target.deliveries))
-		for _, dlv := range target.deliveries {
-			// We do not check the existence of the sender because the NewHandler function guarantees that a sender will exist for all types of delivery.
-			sender := senders[dlv.name]
-			go func(dlv *delivery, msg Message) {
-				defer wg.Done()
-				if err := sender.Send(dlv.recipients, msg); err != nil {
-					log.Infow("Failed to send message", "delivery", dlv.name, zap.Error(err), "message", msg)
-				}
-			}(dlv, msg)
+		msg.Target = targetName
+
+		if queue == nil {
+			deliverMessage(log, target.deliveries, senders, msg, nil, nil)
+			return
 		}
-		wg.Wait()
+		id, err := newQueueID()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Infow("Failed to accept message", zap.Error(err))
+			return
+		}
+		ok, err = queue.push(&queuedMessage{ID: id, Target: targetName, Message: msg, Accepted: time.Now(), log: log})
+		if err == errQueueClosed {
+			msg := fmt.Sprintln("Service is shutting down")
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			log.Info(msg)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Infow("Failed to accept message", zap.Error(err))
+			return
+		}
+		if !ok {
+			msg := fmt.Sprintln("Queue is full")
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			log.Info(msg)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(struct {
+			ID string `json:"id"`
+		}{ID: id}); err != nil {
+			log.Infow("Failed to marshal message ID", zap.Error(err))
+		}
+	}
+}
+
+// deliverMessage sends a message to deliveries concurrently and waits until they finish.
+// Failed deliveries are logged. If done is not nil, it is called after every delivery finishes, successfully or not.
+// If sent is not nil, it is called with every recipient that a delivery has sent the message to independently of other recipients.
+func deliverMessage(log *zap.SugaredLogger, deliveries []*delivery, senders map[DeliveryType]Sender, msg Message, done func(dlv *delivery), sent func(dlv *delivery, rcpt string)) {
+	// Attachments are not logged because of their size.
+	logMsg := msg
+	logMsg.Attachments = nil
+
+	var wg sync.WaitGroup
+	wg.Add(len(deliveries))
+	for _, dlv := range deliveries {
+		// We do not check the existence of the sender because the NewHandler function guarantees that a sender will exist for all types of delivery.
+		sender := senders[dlv.name]
+		go func(dlv *delivery, msg Message) {
+			defer wg.Done()
+			if sent != nil {
+				msg.sent = func(rcpt string) { sent(dlv, rcpt) }
+			}
+			if err := sender.Send(dlv.recipients, msg); err != nil {
+				log.Infow("Failed to send message", "delivery", dlv.name, zap.Error(err), "message", logMsg)
+			}
+			if done != nil {
+				done(dlv)
+			}
+		}(dlv, msg)
 	}
+	wg.Wait()
 }
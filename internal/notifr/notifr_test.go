@@ -8,6 +8,8 @@ LICENSE file in the root directory of this source tree.
 package notifr
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -16,8 +18,8 @@ import (
 	"testing"
 	"time"
 
-	"github.com/domodwyer/mailyak"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
 func TestTargetsConfigDecode(t *testing.T) {
@@ -138,6 +140,22 @@ func TestTargetsConfigDecode(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "all ok, recipient with colons",
+			targets: "test:slack:https://hooks.slack.com/services/T0/B0/X0",
+			want: &TargetsConfig{
+				targets: map[string]*target{
+					"test": {
+						deliveries: []*delivery{
+							{
+								name:       "slack",
+								recipients: []string{"https://hooks.slack.com/services/T0/B0/X0"},
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -163,6 +181,28 @@ func TestTargetsConfigDecode(t *testing.T) {
 	}
 }
 
+func TestTargetsConfigMarshalJSON(t *testing.T) {
+	var cnf TargetsConfig
+	if err := cnf.Decode("test:slack:https://hooks.slack.com/services/T0/B0/X0"); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	got, err := json.Marshal(cnf)
+	if err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if want := `"test:slack:https://hooks.slack.com/…"`; string(got) != want {
+		t.Errorf("got JSON: %s; want JSON: %s", got, want)
+	}
+
+	var cnf2 TargetsConfig
+	if err = cnf2.Decode("test:smtp:email@example.com"); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	if got, _ = json.Marshal(cnf2); string(got) != `"test:smtp:email@example.com"` {
+		t.Errorf("got JSON: %s; want JSON: %s", got, `"test:smtp:email@example.com"`)
+	}
+}
+
 func TestNewHandler(t *testing.T) {
 	testCases := []struct {
 		name                string
@@ -187,11 +227,68 @@ func TestNewHandler(t *testing.T) {
 			supportedDeliveries: map[DeliveryType]Sender{DeliverySMTP: nil},
 			wantErrKind:         errKindInvalidEmail,
 		},
+		{
+			name:                "invalid URL",
+			targets:             "test:slack:hooks.slack.com/services/T0/B0/X0",
+			supportedDeliveries: map[DeliveryType]Sender{DeliverySlack: nil},
+			wantErrKind:         errKindInvalidURL,
+		},
+		{
+			name:                "invalid chat ID",
+			targets:             "test:telegram:chat",
+			supportedDeliveries: map[DeliveryType]Sender{DeliveryTelegram: nil},
+			wantErrKind:         errKindInvalidChatID,
+		},
+		{
+			name:                "invalid room",
+			targets:             "test:matrix:ops",
+			supportedDeliveries: map[DeliveryType]Sender{DeliveryMatrix: nil},
+			wantErrKind:         errKindInvalidRoom,
+		},
+		{
+			name:                "invalid phone number",
+			targets:             "test:sms:89999999999",
+			supportedDeliveries: map[DeliveryType]Sender{DeliverySMS: nil},
+			wantErrKind:         errKindInvalidPhone,
+		},
+		{
+			name:                "invalid topic",
+			targets:             "test:ntfy:ops/alerts",
+			supportedDeliveries: map[DeliveryType]Sender{DeliveryNtfy: nil},
+			wantErrKind:         errKindInvalidTopic,
+		},
+		{
+			name:                "invalid user key",
+			targets:             "test:pushover:ops",
+			supportedDeliveries: map[DeliveryType]Sender{DeliveryPushover: nil},
+			wantErrKind:         errKindInvalidUserKey,
+		},
+		{
+			name:                "invalid address",
+			targets:             "test:syslog:http://logs.example.org",
+			supportedDeliveries: map[DeliveryType]Sender{DeliverySyslog: nil},
+			wantErrKind:         errKindInvalidAddress,
+		},
+		{
+			name:    "unknown recipient",
+			targets: "test:webhook:unknown",
+			supportedDeliveries: map[DeliveryType]Sender{
+				DeliveryWebhook: &WebhookSender{WebhookConfig: WebhookConfig{Endpoints: WebhookEndpoints{
+					endpoints: map[string]*webhookEndpoint{"tickets": {}},
+				}}},
+			},
+			wantErrKind: errKindUnknownRecipient,
+		},
 		{
 			name:                "all ok",
 			targets:             "test:smtp:email@example.com",
 			supportedDeliveries: map[DeliveryType]Sender{DeliverySMTP: nil},
 		},
+		{
+			name:                "all ok, slack",
+			targets:             "test:slack:https://hooks.slack.com/services/T0/B0/X0",
+			supportedDeliveries: map[DeliveryType]Sender{DeliverySlack: nil},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -199,7 +296,7 @@ func TestNewHandler(t *testing.T) {
 			if err := cnf.Decode(tc.targets); err != nil {
 				t.Fatalf("unexpected decode error: %s", err)
 			}
-			_, err := NewHandler(cnf, tc.supportedDeliveries)
+			_, err := NewHandler(cnf, tc.supportedDeliveries, LimitsConfig{}, AsyncConfig{})
 			if tc.wantErrKind != "" {
 				if err == nil {
 					t.Fatalf("got no error; want error kind: %v", tc.wantErrKind)
@@ -219,11 +316,15 @@ func TestNewHandler(t *testing.T) {
 
 func TestHandleSendMessage(t *testing.T) {
 	testCases := []struct {
-		name       string
-		query      string
-		body       string
-		targets    string
-		senders    map[DeliveryType]Sender
+		name        string
+		query       string
+		contentType string
+		body        string
+		targets     string
+		senders     map[DeliveryType]Sender
+		limits      LimitsConfig
+		// chunked hides the length of the body as if it was sent with chunked transfer encoding.
+		chunked    bool
 		wantBody   string
 		wantMsg    Message
 		wantStatus int
@@ -275,6 +376,174 @@ func TestHandleSendMessage(t *testing.T) {
 			wantMsg: Message{
 				Subject: "Test Subject",
 				Text:    "Test Message",
+				Target:  "test",
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "attachment without filename",
+			targets:    "test:smtp:email@example.com",
+			query:      "target=test",
+			body:       `{"text":"Test Message","attachments":[{"content":"YSxiCg=="}]}`,
+			wantBody:   "Missing required fields: attachments.filename",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid reply-to",
+			targets:    "test:smtp:email@example.com",
+			query:      "target=test",
+			body:       `{"text":"Test Message","reply_to":"helpdesk"}`,
+			wantBody:   "Invalid fields: reply_to",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "header with line break",
+			targets:    "test:smtp:email@example.com",
+			query:      "target=test",
+			body:       `{"text":"Test Message","headers":{"X-Ticket-ID":"42\r\nBcc: evil@example.com"}}`,
+			wantBody:   "Invalid fields: headers",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid priority",
+			targets:    "test:smtp:email@example.com",
+			query:      "target=test",
+			body:       `{"text":"Test Message","priority":"urgent"}`,
+			wantBody:   "Invalid fields: priority",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:    "email fields",
+			targets: "test:smtp:email@example.com",
+			query:   "target=test",
+			senders: map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			body:    `{"text":"Test Message","reply_to":"helpdesk@example.com","cc":["Support <support@example.com>"],"headers":{"X-Ticket-ID":"42"},"priority":"high","thread":"incident-42","metadata":{"runbook":"https://wiki.example.com/db"}}`,
+			wantMsg: Message{
+				Text:     "Test Message",
+				Target:   "test",
+				ReplyTo:  "helpdesk@example.com",
+				Cc:       []string{"Support <support@example.com>"},
+				Headers:  map[string]string{"X-Ticket-ID": "42"},
+				Priority: PriorityHigh,
+				Thread:   "incident-42",
+				Metadata: map[string]string{"runbook": "https://wiki.example.com/db"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:    "attachments in JSON",
+			targets: "test:smtp:email@example.com",
+			query:   "target=test",
+			senders: map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			body:    `{"text":"Test Message","attachments":[{"filename":"report.csv","content_type":"text/csv","content":"YSxiCg=="}]}`,
+			wantMsg: Message{
+				Text:        "Test Message",
+				Target:      "test",
+				Attachments: []Attachment{{Filename: "report.csv", ContentType: "text/csv", Content: []byte("a,b\n")}},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "multipart form",
+			targets:     "test:smtp:email@example.com",
+			query:       "target=test",
+			senders:     map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			contentType: "multipart/form-data; boundary=XXX",
+			body: "--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"subject\"\r\n\r\nTest Subject\r\n" +
+				"--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"text\"\r\n\r\n![chart](cid:chart.png)\r\n" +
+				"--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"file\"; filename=\"chart.png\"\r\n" +
+				"Content-Type: image/png\r\n\r\nPNG\r\n" +
+				"--XXX--\r\n",
+			wantMsg: Message{
+				Subject:     "Test Subject",
+				Text:        "![chart](cid:chart.png)",
+				Target:      "test",
+				Attachments: []Attachment{{Filename: "chart.png", ContentType: "image/png", Content: []byte("PNG")}},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "too large body",
+			targets:    "test:smtp:email@example.com",
+			query:      "target=test",
+			senders:    map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			limits:     LimitsConfig{MaxRequestSize: 16},
+			body:       `{"text":"Test Message"}`,
+			wantBody:   "Request body is too large",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "too large chunked body",
+			targets:    "test:smtp:email@example.com",
+			query:      "target=test",
+			senders:    map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			limits:     LimitsConfig{MaxRequestSize: 16},
+			chunked:    true,
+			body:       `{"text":"Test Message"}`,
+			wantBody:   "Request body is too large",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "too large chunked multipart body",
+			targets:     "test:smtp:email@example.com",
+			query:       "target=test",
+			senders:     map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			limits:      LimitsConfig{MaxRequestSize: 64},
+			chunked:     true,
+			contentType: "multipart/form-data; boundary=XXX",
+			body: "--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"text\"\r\n\r\nReport\r\n" +
+				"--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"file\"; filename=\"report.csv\"\r\n\r\na,b,c,d\r\n" +
+				"--XXX--\r\n",
+			wantBody:   "Request body is too large",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "too large attachment",
+			targets:    "test:smtp:email@example.com",
+			query:      "target=test",
+			senders:    map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			limits:     LimitsConfig{MaxAttachmentSize: 4},
+			body:       `{"text":"Report","attachments":[{"filename":"report.csv","content":"YSxiLGMsZA=="}]}`,
+			wantBody:   "Attachment is too large",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "too large multipart attachment",
+			targets:     "test:smtp:email@example.com",
+			query:       "target=test",
+			senders:     map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			limits:      LimitsConfig{MaxAttachmentSize: 4},
+			contentType: "multipart/form-data; boundary=XXX",
+			body: "--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"text\"\r\n\r\nReport\r\n" +
+				"--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"file\"; filename=\"report.csv\"\r\n\r\na,b,c,d\r\n" +
+				"--XXX--\r\n",
+			wantBody:   "Attachment is too large",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "attachment within limits",
+			targets:     "test:smtp:email@example.com",
+			query:       "target=test",
+			senders:     map[DeliveryType]Sender{DeliverySMTP: testNewSender(nil)},
+			limits:      LimitsConfig{MaxRequestSize: 1024, MaxAttachmentSize: 7},
+			chunked:     true,
+			contentType: "multipart/form-data; boundary=XXX",
+			body: "--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"text\"\r\n\r\nReport\r\n" +
+				"--XXX\r\n" +
+				"Content-Disposition: form-data; name=\"file\"; filename=\"report.csv\"\r\n\r\na,b,c,d\r\n" +
+				"--XXX--\r\n",
+			wantMsg: Message{
+				Text:        "Report",
+				Target:      "test",
+				Attachments: []Attachment{{Filename: "report.csv", Content: []byte("a,b,c,d")}},
 			},
 			wantStatus: http.StatusOK,
 		},
@@ -287,6 +556,7 @@ func TestHandleSendMessage(t *testing.T) {
 			wantMsg: Message{
 				Subject: "Test Subject",
 				Text:    "Test Message",
+				Target:  "test",
 			},
 			wantStatus: http.StatusOK,
 		},
@@ -301,13 +571,19 @@ func TestHandleSendMessage(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			if tc.chunked {
+				r.ContentLength = -1
+			}
 
 			rr := httptest.NewRecorder()
 			tgtConf := TargetsConfig{}
 			if err = tgtConf.Decode(tc.targets); err != nil {
 				t.Fatalf("unexpected decode error: %s", err)
 			}
-			newMessageHandler(tgtConf, tc.senders).ServeHTTP(rr, r)
+			newMessageHandler(tgtConf, tc.senders, tc.limits, nil).ServeHTTP(rr, r)
 
 			if code := rr.Code; code != tc.wantStatus {
 				t.Errorf("got status: %d; want status: %d", code, tc.wantStatus)
@@ -323,8 +599,8 @@ func TestHandleSendMessage(t *testing.T) {
 					if !sender.msgSent {
 						t.Errorf("Sender of delivery %q is not called", dlvName)
 					}
-					if sender.msg != tc.wantMsg {
-						t.Errorf("got message: %s; want message: %s", sender.msg, tc.wantMsg)
+					if !reflect.DeepEqual(sender.msg, tc.wantMsg) {
+						t.Errorf("got message: %+v; want message: %+v", sender.msg, tc.wantMsg)
 					}
 				}
 			}
@@ -332,6 +608,124 @@ func TestHandleSendMessage(t *testing.T) {
 	}
 }
 
+func TestHandleSendMessageAsync(t *testing.T) {
+	var tgtConf TargetsConfig
+	if err := tgtConf.Decode("test:smtp:email@example.com"); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	sender := &testBlockingSender{sent: make(chan Message), release: make(chan struct{})}
+	queue, err := newMessageQueue(AsyncConfig{Workers: 1, QueueSize: 1}, tgtConf, map[DeliveryType]Sender{DeliverySMTP: sender})
+	if err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	handler := newMessageHandler(tgtConf, map[DeliveryType]Sender{DeliverySMTP: sender}, LimitsConfig{}, queue)
+	send := func(text string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/?target=test", strings.NewReader(`{"text":"`+text+`"}`)))
+		return rr
+	}
+
+	// The first message is delivered by the worker, the second one waits in the queue, and the third one is rejected.
+	var ids []string
+	for i, text := range []string{"First", "Second"} {
+		rr := send(text)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("message %d: got status: %d; want status: %d", i, rr.Code, http.StatusAccepted)
+		}
+		var resp struct {
+			ID string `json:"id"`
+		}
+		if err = json.NewDecoder(rr.Body).Decode(&resp); err != nil || len(resp.ID) != 32 {
+			t.Fatalf("message %d: got body: %q; want message ID", i, rr.Body.String())
+		}
+		ids = append(ids, resp.ID)
+		if i == 0 {
+			if msg := <-sender.sent; msg.Text != "First" {
+				t.Errorf("got message: %q; want message: %q", msg.Text, "First")
+			}
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("got the same ID %q for different messages; want unique IDs", ids[0])
+	}
+	if rr := send("Third"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status: %d; want status: %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	close(sender.release)
+	select {
+	case msg := <-sender.sent:
+		if msg.Text != "Second" || msg.Target != "test" {
+			t.Errorf("got message: %+v; want message %q of target %q", msg, "Second", "test")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("got no queued message; want message")
+	}
+}
+
+func TestMessageQueueClose(t *testing.T) {
+	var tgtConf TargetsConfig
+	if err := tgtConf.Decode("test:smtp:email@example.com"); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	newQueue := func(sender Sender) *messageQueue {
+		queue, err := newMessageQueue(AsyncConfig{Workers: 1, QueueSize: 2}, tgtConf, map[DeliveryType]Sender{DeliverySMTP: sender})
+		if err != nil {
+			t.Fatalf("got error: %v; want no error", err)
+		}
+		return queue
+	}
+	push := func(queue *messageQueue, text string) error {
+		_, err := queue.push(&queuedMessage{ID: text, Target: "test", Message: Message{Text: text}, log: zap.NewNop().Sugar()})
+		return err
+	}
+
+	// Queued messages are delivered before the queue is closed.
+	sender := &testBlockingSender{sent: make(chan Message, 2), release: make(chan struct{})}
+	close(sender.release)
+	queue := newQueue(sender)
+	for _, text := range []string{"First", "Second"} {
+		if err := push(queue, text); err != nil {
+			t.Fatalf("got error: %v; want no error", err)
+		}
+	}
+	if err := queue.close(context.Background()); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if len(sender.sent) != 2 {
+		t.Errorf("got delivered messages: %d; want delivered messages: 2", len(sender.sent))
+	}
+	if err := push(queue, "Third"); err != errQueueClosed {
+		t.Errorf("got error: %v; want error: %v", err, errQueueClosed)
+	}
+
+	// Closing does not wait for a message longer than the context allows.
+	sender = &testBlockingSender{sent: make(chan Message), release: make(chan struct{})}
+	defer close(sender.release)
+	queue = newQueue(sender)
+	if err := push(queue, "First"); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	<-sender.sent
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.close(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("got error: %v; want error: %v", err, context.DeadlineExceeded)
+	}
+}
+
+// testBlockingSender is a sender that reports messages and blocks until it is released.
+type testBlockingSender struct {
+	sent    chan Message
+	release chan struct{}
+}
+
+func (s *testBlockingSender) Send(recipients []string, msg Message) error {
+	s.sent <- msg
+	<-s.release
+	return nil
+}
+
 type testSender struct {
 	err     error
 	msg     Message
@@ -390,7 +784,7 @@ func TestSMTPSender(t *testing.T) {
 				cnt  int
 				errs = append([]error{}, tc.errs...)
 			)
-			sender.sendfn = func(mail *mailyak.MailYak) error {
+			sender.sendfn = func(from string, to []string, data []byte) error {
 				cnt++
 				if len(errs) == 0 {
 					return nil
@@ -0,0 +1,126 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pop3Timeout is a timeout of a POP3 command.
+const pop3Timeout = time.Minute
+
+// pop3Conn is a connection to a POP3 server (https://tools.ietf.org/html/rfc1939).
+type pop3Conn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// dialPOP3 connects to a POP3 server and logs in to a mailbox.
+func dialPOP3(cnf BounceConfig) (*pop3Conn, error) {
+	addr := net.JoinHostPort(cnf.Host, strconv.Itoa(cnf.Port))
+	d := &net.Dialer{Timeout: pop3Timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if cnf.TLS {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, &tls.Config{ServerName: cnf.Host})
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to POP3 server")
+	}
+	c := &pop3Conn{conn: conn, text: textproto.NewConn(conn)}
+	if err = c.conn.SetDeadline(time.Now().Add(pop3Timeout)); err != nil {
+		c.close()
+		return nil, err
+	}
+	if _, err = c.readResponse(); err != nil {
+		c.close()
+		return nil, err
+	}
+	if _, err = c.cmd("USER %s", cnf.Username); err != nil {
+		c.close()
+		return nil, errors.Wrap(err, "failed to log in to POP3 server")
+	}
+	if _, err = c.cmd("PASS %s", cnf.Password); err != nil {
+		c.close()
+		return nil, errors.Wrap(err, "failed to log in to POP3 server")
+	}
+	return c, nil
+}
+
+// cmd sends a command and returns the text of a positive response.
+func (c *pop3Conn) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(pop3Timeout)); err != nil {
+		return "", err
+	}
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.readResponse()
+}
+
+// readResponse reads a response and returns an error if the response is negative (-ERR).
+func (c *pop3Conn) readResponse() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return "", fmt.Errorf("POP3 server responded %q", line)
+	}
+	return strings.TrimSpace(line[len("+OK"):]), nil
+}
+
+// count returns a number of emails in a mailbox.
+func (c *pop3Conn) count() (int, error) {
+	resp, err := c.cmd("STAT")
+	if err != nil {
+		return 0, err
+	}
+	if fields := strings.Fields(resp); len(fields) != 0 {
+		if n, err := strconv.Atoi(fields[0]); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid POP3 response %q to STAT", resp)
+}
+
+// retr returns an email with a number.
+func (c *pop3Conn) retr(n int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", n); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotBytes()
+}
+
+// dele marks an email with a number as deleted.
+func (c *pop3Conn) dele(n int) error {
+	_, err := c.cmd("DELE %d", n)
+	return err
+}
+
+// quit ends a session, and the server removes the deleted emails.
+func (c *pop3Conn) quit() error {
+	_, err := c.cmd("QUIT")
+	return err
+}
+
+func (c *pop3Conn) close() {
+	c.text.Close()
+}
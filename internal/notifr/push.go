@@ -0,0 +1,215 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NtfyConfig is configuration for an ntfy server.
+type NtfyConfig struct {
+	ServerURL string          `envconfig:"server_url" default:"https://ntfy.sh" desc:"a base URL of an ntfy server"`
+	Token     string          `envconfig:"token" json:"-" desc:"an access token of an ntfy user"`
+	Timeout   time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to ntfy"`
+	Retries   []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// NtfySender is a message sender that publishes a message to ntfy topics.
+// Recipients of the delivery are topic names.
+type NtfySender struct {
+	NtfyConfig
+	client *http.Client
+}
+
+// NewNtfySender returns a new NtfySender.
+func NewNtfySender(cnf NtfyConfig) *NtfySender {
+	return &NtfySender{
+		NtfyConfig: cnf,
+		client:     &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// ntfyMessage is a payload of the ntfy JSON publishing API (https://docs.ntfy.sh/publish/#publish-as-json).
+type ntfyMessage struct {
+	Topic    string `json:"topic"`
+	Title    string `json:"title,omitempty"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority,omitempty"`
+	Markdown bool   `json:"markdown"`
+}
+
+// ntfyPriorities are priorities of ntfy messages for severities of messages.
+var ntfyPriorities = map[string]int{
+	"critical": 5,
+	"error":    4,
+	"warning":  4,
+	"info":     3,
+	"ok":       2,
+	"resolved": 2,
+}
+
+// Send publishes a message to ntfy topics.
+// ntfy renders Markdown natively, so a message's text is sent as is.
+func (s *NtfySender) Send(recipients []string, msg Message) error {
+	return sendEach(recipients, msg, func(topic string) error {
+		nm := &ntfyMessage{
+			Topic:    topic,
+			Title:    msg.Subject,
+			Message:  msg.Text,
+			Priority: ntfyPriorities[strings.ToLower(msg.Severity)],
+			Markdown: true,
+		}
+		return retry(s.Retries, func() error {
+			req, err := newJSONRequest(http.MethodPost, strings.TrimRight(s.ServerURL, "/"), nm)
+			if err != nil {
+				return hideURL(err)
+			}
+			if s.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+s.Token)
+			}
+			return hideURL(doHTTP(s.client, req, nil))
+		})
+	})
+}
+
+// GotifyConfig is configuration for a Gotify server.
+type GotifyConfig struct {
+	ServerURL string            `envconfig:"server_url" desc:"a base URL of a Gotify server; the delivery is disabled when the URL is empty"`
+	Apps      map[string]string `envconfig:"apps" json:"-" desc:"tokens of Gotify applications by their names (<name>:<token>,<name>:<token>)"`
+	Timeout   time.Duration     `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Gotify"`
+	Retries   []time.Duration   `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// GotifySender is a message sender that sends a message to Gotify applications.
+// Recipients of the delivery are names of applications which tokens are configured.
+type GotifySender struct {
+	GotifyConfig
+	client *http.Client
+}
+
+// NewGotifySender returns a new GotifySender.
+func NewGotifySender(cnf GotifyConfig) *GotifySender {
+	return &GotifySender{
+		GotifyConfig: cnf,
+		client:       &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// gotifyMessage is a payload of the Gotify API (https://gotify.net/api-docs#/message/createMessage).
+type gotifyMessage struct {
+	Title    string                 `json:"title,omitempty"`
+	Message  string                 `json:"message"`
+	Priority int                    `json:"priority,omitempty"`
+	Extras   map[string]interface{} `json:"extras"`
+}
+
+// gotifyPriorities are priorities of Gotify messages for severities of messages.
+var gotifyPriorities = map[string]int{
+	"critical": 10,
+	"error":    8,
+	"warning":  5,
+	"info":     3,
+	"ok":       1,
+	"resolved": 1,
+}
+
+// hasRecipient returns true if a token of an application with the name is configured.
+func (s *GotifySender) hasRecipient(app string) bool {
+	_, ok := s.Apps[app]
+	return ok
+}
+
+// Send sends a message to Gotify applications.
+// A message's text is marked as Markdown, so Gotify clients render it.
+func (s *GotifySender) Send(recipients []string, msg Message) error {
+	gm := &gotifyMessage{
+		Title:    msg.Subject,
+		Message:  msg.Text,
+		Priority: gotifyPriorities[strings.ToLower(msg.Severity)],
+		Extras: map[string]interface{}{
+			"client::display": map[string]string{"contentType": "text/markdown"},
+		},
+	}
+	return sendEach(recipients, msg, func(app string) error {
+		return retry(s.Retries, func() error {
+			req, err := newJSONRequest(http.MethodPost, strings.TrimRight(s.ServerURL, "/")+"/message", gm)
+			if err != nil {
+				return hideURL(err)
+			}
+			req.Header.Set("X-Gotify-Key", s.Apps[app])
+			return hideURL(doHTTP(s.client, req, nil))
+		})
+	})
+}
+
+// PushoverConfig is configuration for Pushover.
+type PushoverConfig struct {
+	Token   string          `envconfig:"token" json:"-" desc:"an API token of a Pushover application; the delivery is disabled when the token is empty"`
+	APIURL  string          `envconfig:"api_url" default:"https://api.pushover.net" desc:"a base URL of the Pushover API"`
+	Timeout time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Pushover"`
+	Retries []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// PushoverSender is a message sender that sends a message to Pushover users.
+// Recipients of the delivery are user or group keys.
+type PushoverSender struct {
+	PushoverConfig
+	client *http.Client
+}
+
+// NewPushoverSender returns a new PushoverSender.
+func NewPushoverSender(cnf PushoverConfig) *PushoverSender {
+	return &PushoverSender{
+		PushoverConfig: cnf,
+		client:         &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// Pushover limits the length of messages' fields (https://pushover.net/api#limits).
+const (
+	pushoverTitleMaxLen   = 250
+	pushoverMessageMaxLen = 1024
+)
+
+// pushoverMessage is a payload of the Pushover API (https://pushover.net/api#messages).
+type pushoverMessage struct {
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Title    string `json:"title,omitempty"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// pushoverPriorities are priorities of Pushover messages for severities of messages.
+// The emergency priority is not used because it requires an acknowledgement of a message.
+var pushoverPriorities = map[string]int{
+	"critical": 1,
+	"error":    1,
+	"ok":       -1,
+	"resolved": -1,
+}
+
+// Send sends a message to Pushover users.
+// Pushover does not support Markdown, so a message's text is flattened to plain text.
+func (s *PushoverSender) Send(recipients []string, msg Message) error {
+	title := truncateText(msg.Subject, pushoverTitleMaxLen)
+	text := truncateText(plainTextRenderer.render(msg.Text), pushoverMessageMaxLen)
+	if text == "" {
+		// Pushover rejects a message without a text.
+		text = title
+	}
+	priority := pushoverPriorities[strings.ToLower(msg.Severity)]
+	return sendEach(recipients, msg, func(user string) error {
+		pm := &pushoverMessage{Token: s.Token, User: user, Title: title, Message: text, Priority: priority}
+		return retry(s.Retries, func() error {
+			return hideURL(postJSON(s.client, strings.TrimRight(s.APIURL, "/")+"/1/messages.json", pm, nil))
+		})
+	})
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushSenders(t *testing.T) {
+	var (
+		gotPath    string
+		gotHeader  http.Header
+		gotPayload map[string]interface{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotHeader, gotPayload = r.URL.Path, r.Header, nil
+		if err := json.NewDecoder(r.Body).Decode(&gotPayload); err != nil {
+			t.Errorf("failed to decode payload: %s", err)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	msg := Message{Subject: "Alert", Text: "**Disk** is full", Severity: "critical"}
+	retries := []time.Duration{0}
+	testCases := []struct {
+		name        string
+		sender      Sender
+		rcpt        string
+		wantPath    string
+		wantHeader  [2]string
+		wantPayload map[string]interface{}
+	}{
+		{
+			name:       "ntfy",
+			sender:     NewNtfySender(NtfyConfig{ServerURL: srv.URL, Token: "test-token", Retries: retries}),
+			rcpt:       "ops",
+			wantPath:   "/",
+			wantHeader: [2]string{"Authorization", "Bearer test-token"},
+			wantPayload: map[string]interface{}{
+				"topic":    "ops",
+				"title":    "Alert",
+				"message":  "**Disk** is full",
+				"priority": 5.0,
+				"markdown": true,
+			},
+		},
+		{
+			name:       "gotify",
+			sender:     NewGotifySender(GotifyConfig{ServerURL: srv.URL, Apps: map[string]string{"ops": "test-token"}, Retries: retries}),
+			rcpt:       "ops",
+			wantPath:   "/message",
+			wantHeader: [2]string{"X-Gotify-Key", "test-token"},
+			wantPayload: map[string]interface{}{
+				"title":    "Alert",
+				"message":  "**Disk** is full",
+				"priority": 10.0,
+				"extras": map[string]interface{}{
+					"client::display": map[string]interface{}{"contentType": "text/markdown"},
+				},
+			},
+		},
+		{
+			name:       "pushover",
+			sender:     NewPushoverSender(PushoverConfig{Token: "test-token", APIURL: srv.URL, Retries: retries}),
+			rcpt:       "uQiRzpo4DXghDmr9QzzfQu27cmVRsG",
+			wantPath:   "/1/messages.json",
+			wantHeader: [2]string{"Content-Type", "application/json"},
+			wantPayload: map[string]interface{}{
+				"token":    "test-token",
+				"user":     "uQiRzpo4DXghDmr9QzzfQu27cmVRsG",
+				"title":    "Alert",
+				"message":  "Disk is full",
+				"priority": 1.0,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.sender.Send([]string{tc.rcpt}, msg); err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if gotPath != tc.wantPath {
+				t.Errorf("got path: %q; want path: %q", gotPath, tc.wantPath)
+			}
+			if v := gotHeader.Get(tc.wantHeader[0]); v != tc.wantHeader[1] {
+				t.Errorf("got header %s: %q; want header %s: %q", tc.wantHeader[0], v, tc.wantHeader[0], tc.wantHeader[1])
+			}
+			if !reflect.DeepEqual(gotPayload, tc.wantPayload) {
+				t.Errorf("got payload: %v; want payload: %v", gotPayload, tc.wantPayload)
+			}
+		})
+	}
+}
+
+func TestPushSendersConnectionError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	retries := []time.Duration{0}
+	senders := map[string]Sender{
+		"ntfy":   NewNtfySender(NtfyConfig{ServerURL: srv.URL + "/secret-path", Retries: retries}),
+		"gotify": NewGotifySender(GotifyConfig{ServerURL: srv.URL + "/secret-path", Apps: map[string]string{"ops": "test-token"}, Retries: retries}),
+	}
+	for name, sender := range senders {
+		err := sender.Send([]string{"ops"}, Message{Text: "Test"})
+		if err == nil {
+			t.Errorf("%s: got no error; want error", name)
+			continue
+		}
+		if strings.Contains(err.Error(), "secret-path") {
+			t.Errorf("%s: got error: %v; want error without the server URL", name, err)
+		}
+	}
+}
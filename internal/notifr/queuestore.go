@@ -0,0 +1,131 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// messageStore stores queued messages in a directory, a message per file <id>.json.
+// A file is replaced atomically, so a crash leaves either the previous or the next version of a message.
+type messageStore struct {
+	dir string
+}
+
+// openMessageStore creates a directory of a store if it does not exist.
+func openMessageStore(dir string) (*messageStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create queue directory")
+	}
+	return &messageStore{dir: dir}, nil
+}
+
+func (st *messageStore) path(id string) string {
+	return filepath.Join(st.dir, id+".json")
+}
+
+// save writes a message to its file atomically.
+func (st *messageStore) save(m *queuedMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal queued message")
+	}
+	if err = writeFileAtomic(st.path(m.ID), b); err != nil {
+		return errors.Wrap(err, "failed to store queued message")
+	}
+	return nil
+}
+
+// remove removes a message's file.
+func (st *messageStore) remove(id string) error {
+	if err := os.Remove(st.path(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove queued message")
+	}
+	syncDir(st.dir)
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to a file with a path, after the data is flushed to the disk.
+// So a crash leaves either the previous or the next version of the file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes a directory's entries to the disk, so a renamed or removed file is not restored after a crash.
+// It is not supported on some platforms, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// load returns the stored messages in the order of their acceptance.
+// Temporary files of interrupted writes are removed. A file that cannot be parsed is renamed to <id>.json.corrupted,
+// so it is kept for investigation but is not loaded again, and the function returns an error for it.
+func (st *messageStore) load() ([]*queuedMessage, []error) {
+	files, err := ioutil.ReadDir(st.dir)
+	if err != nil {
+		return nil, []error{errors.Wrap(err, "failed to read queue directory")}
+	}
+	var (
+		msgs []*queuedMessage
+		errs []error
+	)
+	for _, fi := range files {
+		path := filepath.Join(st.dir, fi.Name())
+		switch {
+		case strings.HasSuffix(fi.Name(), ".json.tmp"):
+			os.Remove(path)
+		case strings.HasSuffix(fi.Name(), ".json"):
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "failed to read %q", path))
+				continue
+			}
+			m := &queuedMessage{}
+			if err = json.Unmarshal(b, m); err != nil || m.ID+".json" != fi.Name() {
+				if err == nil {
+					err = errors.New("message ID does not match the file name")
+				}
+				errs = append(errs, errors.Wrapf(err, "invalid queued message %q", path))
+				os.Rename(path, path+".corrupted")
+				continue
+			}
+			msgs = append(msgs, m)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Accepted.Before(msgs[j].Accepted) })
+	return msgs, errs
+}
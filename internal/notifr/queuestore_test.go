@@ -0,0 +1,198 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMessageQueueRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{"broken.json": "{", "interrupted.json.tmp": "{"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var targets TargetsConfig
+	if err = targets.Decode("test:smtp:email@example.com,test:slack:https://hooks.example.org/test"); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	cnf := AsyncConfig{Enabled: true, Workers: 1, QueueSize: 10, QueueDir: dir}
+
+	// The SMTP delivery hangs, e.g. in a retry's sleep, when the process is restarted.
+	smtp := &testBlockingSender{sent: make(chan Message, 1), release: make(chan struct{})}
+	defer close(smtp.release)
+	slack := testNewSender(nil)
+	h, err := NewHandler(targets, map[DeliveryType]Sender{DeliverySMTP: smtp, DeliverySlack: slack}, LimitsConfig{}, cnf)
+	if err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	body := `{"text":"Test","attachments":[{"filename":"a.txt","content":"SGVsbG8="}]}`
+	rr := httptest.NewRecorder()
+	newMessageHandler(h.targets, h.senders, h.limits, h.queue).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/?target=test", strings.NewReader(body)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status: %d; want status: %d", rr.Code, http.StatusAccepted)
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err = json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	<-smtp.sent
+	slack.wg.Wait()
+	waitFor(t, "finished Slack delivery", func() bool {
+		b, err := ioutil.ReadFile(filepath.Join(dir, resp.ID+".json"))
+		return err == nil && strings.Contains(string(b), `"done":["slack"]`)
+	})
+
+	// After the restart, only the unfinished SMTP delivery is resumed.
+	smtp2, slack2 := testNewSender(nil), testNewSender(nil)
+	h2, err := NewHandler(targets, map[DeliveryType]Sender{DeliverySMTP: smtp2, DeliverySlack: slack2}, LimitsConfig{}, cnf)
+	if err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	h2.Resume(zap.NewNop())
+	smtp2.wg.Wait()
+	want := Message{Text: "Test", Target: "test", Attachments: []Attachment{{Filename: "a.txt", Content: []byte("Hello")}}}
+	// The progress callback of a queued message is not compared.
+	got := smtp2.msg
+	got.sent = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got message: %+v; want message: %+v", got, want)
+	}
+	waitFor(t, "removed queued message", func() bool {
+		_, err := os.Stat(filepath.Join(dir, resp.ID+".json"))
+		return os.IsNotExist(err)
+	})
+	if slack2.msgSent {
+		t.Errorf("got resumed Slack delivery; want no delivery")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if want := []string{"broken.json.corrupted"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got files: %q; want files: %q", names, want)
+	}
+}
+
+func TestMessageQueueResumeRecipients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var targets TargetsConfig
+	if err = targets.Decode("test:smtp:a@example.org,test:smtp:b@example.org,test:smtp:c@example.org"); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	cnf := AsyncConfig{Enabled: true, Workers: 1, QueueSize: 10, QueueDir: dir}
+
+	// The process is killed while the message is being sent to the second recipient.
+	smtp := &testEachSender{block: "b@example.org", release: make(chan struct{})}
+	defer close(smtp.release)
+	h, err := NewHandler(targets, map[DeliveryType]Sender{DeliverySMTP: smtp}, LimitsConfig{}, cnf)
+	if err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	rr := httptest.NewRecorder()
+	newMessageHandler(h.targets, h.senders, h.limits, h.queue).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/?target=test", strings.NewReader(`{"text":"Test"}`)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status: %d; want status: %d", rr.Code, http.StatusAccepted)
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err = json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	waitFor(t, "stored progress", func() bool {
+		b, err := ioutil.ReadFile(filepath.Join(dir, resp.ID+".json"))
+		return err == nil && strings.Contains(string(b), `"sent":{"smtp":["a@example.org"]}`)
+	})
+
+	// After the restart, the message is sent only to the recipients that have not got it.
+	smtp2 := &testEachSender{}
+	h2, err := NewHandler(targets, map[DeliveryType]Sender{DeliverySMTP: smtp2}, LimitsConfig{}, cnf)
+	if err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	h2.Resume(zap.NewNop())
+	waitFor(t, "removed queued message", func() bool {
+		_, err := os.Stat(filepath.Join(dir, resp.ID+".json"))
+		return os.IsNotExist(err)
+	})
+	if got, want := smtp2.recipients(), []string{"b@example.org", "c@example.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got recipients: %q; want recipients: %q", got, want)
+	}
+}
+
+// testEachSender is a sender that sends a message to recipients one by one and records them.
+// Sending to the recipient block hangs until the sender is released.
+type testEachSender struct {
+	block   string
+	release chan struct{}
+
+	mu    sync.Mutex
+	rcpts []string
+}
+
+func (s *testEachSender) Send(recipients []string, msg Message) error {
+	return sendEach(recipients, msg, func(rcpt string) error {
+		if rcpt == s.block {
+			<-s.release
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.rcpts = append(s.rcpts, rcpt)
+		return nil
+	})
+}
+
+func (s *testEachSender) recipients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.rcpts...)
+}
+
+// waitFor waits until a condition is true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("got no %s; want %s", what, what)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SlackConfig is configuration for Slack incoming webhooks.
+type SlackConfig struct {
+	Timeout time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Slack"`
+	Retries []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// SlackSender is a message sender that sends a message to Slack incoming webhooks.
+// Recipients of the delivery are webhook URLs.
+type SlackSender struct {
+	SlackConfig
+	client *http.Client
+}
+
+// NewSlackSender returns a new SlackSender.
+func NewSlackSender(cnf SlackConfig) *SlackSender {
+	return &SlackSender{
+		SlackConfig: cnf,
+		client:      &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// Slack limits the length of texts in message blocks (https://api.slack.com/reference/block-kit/blocks),
+// and truncates the field "text" of a message that is longer than 4000 characters (https://api.slack.com/methods/chat.postMessage#truncating).
+const (
+	slackHeaderMaxLen  = 150
+	slackSectionMaxLen = 3000
+	slackTextMaxLen    = 4000
+)
+
+// slackMessage is a payload of Slack incoming webhooks.
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Send sends a message to Slack incoming webhooks.
+// The method tries to re-send a message when the previous sending failed with a temporary error.
+func (s *SlackSender) Send(recipients []string, msg Message) error {
+	payload := newSlackMessage(msg)
+	return sendEach(recipients, msg, func(url string) error {
+		return retry(s.Retries, func() error { return hideURL(postJSON(s.client, url, payload, nil)) })
+	})
+}
+
+// newSlackMessage converts a message to a Slack message.
+// A message's subject becomes a header block, and a message's text becomes section blocks in Slack mrkdwn format.
+func newSlackMessage(msg Message) *slackMessage {
+	var sm slackMessage
+	if msg.Subject != "" {
+		sm.Blocks = append(sm.Blocks, slackBlock{
+			Type: "header",
+			Text: &slackText{Type: "plain_text", Text: truncateText(msg.Subject, slackHeaderMaxLen)},
+		})
+	}
+	text := slackMrkdwn(msg.Text)
+	for _, chunk := range splitText(text, slackSectionMaxLen) {
+		sm.Blocks = append(sm.Blocks, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: chunk},
+		})
+	}
+	// The field "text" is used by Slack in notifications.
+	sm.Text = msg.Subject
+	if sm.Text == "" {
+		sm.Text = truncateText(text, slackTextMaxLen)
+	}
+	return &sm
+}
+
+// slackEscaper escapes control characters of Slack mrkdwn (https://api.slack.com/reference/surfaces/formatting#escaping).
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackRenderer renders Markdown to Slack mrkdwn (https://api.slack.com/reference/surfaces/formatting).
+var slackRenderer = &textRenderer{
+	escape:    slackEscaper.Replace,
+	emph:      [2]string{"_", "_"},
+	strong:    [2]string{"*", "*"},
+	del:       [2]string{"~", "~"},
+	code:      func(code string) string { return "`" + slackEscaper.Replace(code) + "`" },
+	codeBlock: func(lang, code string) string { return "```\n" + slackEscaper.Replace(code) + "\n```" },
+	link: func(dest, text string) string {
+		dest = slackEscaper.Replace(dest)
+		if text == "" || text == dest {
+			return "<" + dest + ">"
+		}
+		return "<" + dest + "|" + text + ">"
+	},
+	quote:  func(blocks []string) string { return prefixLines(strings.Join(blocks, "\n"), "> ", "> ") },
+	hr:     "───",
+	bullet: "• ",
+}
+
+// slackMrkdwn converts a Markdown text to Slack mrkdwn format.
+func slackMrkdwn(text string) string {
+	return slackRenderer.render(text)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlackMrkdwn(t *testing.T) {
+	testCases := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "emphasis",
+			text: "**bold** and *italic* and ~~strike~~",
+			want: "*bold* and _italic_ and ~strike~",
+		},
+		{
+			name: "link",
+			text: "[Grafana](https://grafana.example.org/d/1?a=1&b=2)",
+			want: "<https://grafana.example.org/d/1?a=1&amp;b=2|Grafana>",
+		},
+		{
+			name: "heading and paragraph",
+			text: "# Title\n\nSome <text>",
+			want: "*Title*\n\nSome &lt;text&gt;",
+		},
+		{
+			name: "bullet list",
+			text: "- First\n- Second\n  - Nested",
+			want: "• First\n• Second\n  • Nested",
+		},
+		{
+			name: "ordered list",
+			text: "1. First\n2. Second",
+			want: "1. First\n2. Second",
+		},
+		{
+			name: "code",
+			text: "Run `make`:\n\n```\nif a < b {\n}\n```",
+			want: "Run `make`:\n\n```\nif a &lt; b {\n}\n```",
+		},
+		{
+			name: "quote",
+			text: "> line 1\n>\n> line 2",
+			want: "> line 1\n> line 2",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := slackMrkdwn(tc.text); got != tc.want {
+				t.Errorf("got mrkdwn: %q; want mrkdwn: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewSlackMessageLongText(t *testing.T) {
+	sm := newSlackMessage(Message{Text: strings.Repeat("a", slackTextMaxLen+10)})
+	if n := len([]rune(sm.Text)); n != slackTextMaxLen {
+		t.Errorf("got text length: %d; want text length: %d", n, slackTextMaxLen)
+	}
+	if n := len(sm.Blocks); n != 2 {
+		t.Errorf("got blocks: %d; want blocks: 2", n)
+	}
+}
+
+func TestSlackSender(t *testing.T) {
+	testCases := []struct {
+		name        string
+		statuses    []int
+		msg         Message
+		wantRetries int
+		wantErr     bool
+		wantPayload *slackMessage
+	}{
+		{
+			name:        "ok",
+			statuses:    []int{http.StatusOK},
+			msg:         Message{Subject: "Alert", Text: "**Disk** is full"},
+			wantRetries: 1,
+			wantPayload: &slackMessage{
+				Text: "Alert",
+				Blocks: []slackBlock{
+					{Type: "header", Text: &slackText{Type: "plain_text", Text: "Alert"}},
+					{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "*Disk* is full"}},
+				},
+			},
+		},
+		{
+			name:        "without subject",
+			statuses:    []int{http.StatusOK},
+			msg:         Message{Text: "Disk is full"},
+			wantRetries: 1,
+			wantPayload: &slackMessage{
+				Text: "Disk is full",
+				Blocks: []slackBlock{
+					{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "Disk is full"}},
+				},
+			},
+		},
+		{
+			name:        "partially failed",
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			msg:         Message{Text: "Disk is full"},
+			wantRetries: 3,
+		},
+		{
+			name:        "permanent error",
+			statuses:    []int{http.StatusNotFound},
+			msg:         Message{Text: "Disk is full"},
+			wantRetries: 1,
+			wantErr:     true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				cnt     int
+				payload *slackMessage
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cnt++
+				payload = &slackMessage{}
+				if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+					t.Errorf("failed to decode payload: %s", err)
+				}
+				w.WriteHeader(tc.statuses[cnt-1])
+			}))
+			defer srv.Close()
+
+			sender := NewSlackSender(SlackConfig{Retries: []time.Duration{0, 0, 0}})
+			err := sender.Send([]string{srv.URL + "/services/T0/B0/X0"}, tc.msg)
+
+			if cnt != tc.wantRetries {
+				t.Errorf("got retries: %d; want retries: %d", cnt, tc.wantRetries)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				if strings.Contains(err.Error(), "X0") {
+					t.Errorf("got error: %v; want error without the webhook URL", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if tc.wantPayload != nil && !reflect.DeepEqual(payload, tc.wantPayload) {
+				t.Errorf("got payload: %+v; want payload: %+v", payload, tc.wantPayload)
+			}
+		})
+	}
+}
+
+func TestSlackSenderConnectionError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	err := NewSlackSender(SlackConfig{Retries: []time.Duration{0}}).Send([]string{srv.URL + "/services/T0/B0/X0"}, Message{Text: "Test"})
+	if err == nil {
+		t.Fatal("got no error; want error")
+	}
+	if strings.Contains(err.Error(), "X0") {
+		t.Errorf("got error: %v; want error without the webhook URL", err)
+	}
+}
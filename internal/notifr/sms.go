@@ -0,0 +1,165 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SMSConfig is configuration for an HTTP SMS gateway.
+type SMSConfig struct {
+	GatewayURL  string            `envconfig:"gateway_url" desc:"a URL of an HTTP API of an SMS gateway; the delivery is disabled when the URL is empty"`
+	Method      string            `envconfig:"method" default:"POST" desc:"an HTTP method of a request to an SMS gateway"`
+	Headers     map[string]string `envconfig:"headers" json:"-" desc:"HTTP headers of a request to an SMS gateway (<name>:<value>,<name>:<value>)"`
+	ContentType string            `envconfig:"content_type" default:"application/json" desc:"a content type of a request to an SMS gateway"`
+	Body        SMSBody           `envconfig:"body" default:"{\"to\": {{json .To}}, \"text\": {{json .Text}}}" desc:"a Go template of a request body with the fields .To and .Text"`
+	Segments    int               `envconfig:"segments" default:"1" desc:"a maximum number of SMS segments of a message"`
+	Timeout     time.Duration     `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to an SMS gateway"`
+	Retries     []time.Duration   `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// SMSBody is a template of a request body of an SMS gateway.
+// The template is a Go text/template that is executed with a recipient's phone number (.To) and a message's text (.Text).
+// The template can use the same functions as templates of webhook bodies.
+type SMSBody struct {
+	text string
+	tmpl *template.Template
+}
+
+// Decode parses a template of a request body.
+func (b *SMSBody) Decode(value string) error {
+	tmpl, err := template.New("sms").Funcs(webhookFuncs).Parse(value)
+	if err != nil {
+		return errors.Wrap(err, "invalid SMS body template")
+	}
+	b.text, b.tmpl = value, tmpl
+	return nil
+}
+
+// MarshalJSON serializes SMSBody to the template's text.
+func (b SMSBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.text)
+}
+
+// SMSSender is a message sender that sends a message as SMS through an HTTP gateway.
+// Recipients of the delivery are phone numbers in the E.164 format.
+type SMSSender struct {
+	SMSConfig
+	client *http.Client
+}
+
+// NewSMSSender returns a new SMSSender.
+func NewSMSSender(cnf SMSConfig) *SMSSender {
+	return &SMSSender{
+		SMSConfig: cnf,
+		client:    &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// smsData is data of a template of a request body.
+type smsData struct {
+	To   string
+	Text string
+}
+
+// Send sends a message to phone numbers.
+// Markdown of a message is flattened to plain text, and the text is trimmed to the configured number of SMS segments.
+// The message's subject, if any, is put on the first line.
+func (s *SMSSender) Send(recipients []string, msg Message) error {
+	text := plainTextRenderer.render(msg.Text)
+	if msg.Subject != "" {
+		text = strings.TrimSpace(msg.Subject + "\n" + text)
+	}
+	text = truncateSMS(text, s.Segments)
+	return sendEach(recipients, msg, func(phone string) error {
+		var body bytes.Buffer
+		if err := s.Body.tmpl.Execute(&body, &smsData{To: phone, Text: text}); err != nil {
+			return errors.Wrap(err, "failed to render body")
+		}
+		return retry(s.Retries, func() error {
+			req, err := http.NewRequest(s.Method, s.GatewayURL, bytes.NewReader(body.Bytes()))
+			if err != nil {
+				return hideURL(err)
+			}
+			req.Header.Set("Content-Type", s.ContentType)
+			for k, v := range s.Headers {
+				req.Header.Set(k, v)
+			}
+			return hideURL(doHTTP(s.client, req, nil))
+		})
+	})
+}
+
+// Length limits of SMS (3GPP TS 23.038, TS 23.040).
+// A long message is split into segments with a header that takes a part of every segment.
+const (
+	smsGSMMaxLen         = 160
+	smsGSMSegmentLen     = 153
+	smsUnicodeMaxLen     = 70
+	smsUnicodeSegmentLen = 67
+)
+
+// GSM 03.38 alphabet. Characters of the extension table take two septets.
+const (
+	gsmBasicChars     = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsmExtensionChars = "\f^{}\\[~]|€"
+)
+
+// truncateSMS cuts a text to fit in the number of SMS segments.
+// A text that contains only characters of the GSM alphabet is encoded with 7 bits per character,
+// and other texts are encoded with UCS-2.
+func truncateSMS(s string, segments int) string {
+	gsm := true
+	for _, c := range s {
+		if !strings.ContainsRune(gsmBasicChars, c) && !strings.ContainsRune(gsmExtensionChars, c) {
+			gsm = false
+			break
+		}
+	}
+	size := func(c rune) int {
+		switch {
+		case gsm && strings.ContainsRune(gsmExtensionChars, c):
+			return 2
+		case !gsm && c > 0xFFFF:
+			// A character outside of the Basic Multilingual Plane takes a surrogate pair.
+			return 2
+		}
+		return 1
+	}
+	maxLen, segmentLen := smsGSMMaxLen, smsGSMSegmentLen
+	if !gsm {
+		maxLen, segmentLen = smsUnicodeMaxLen, smsUnicodeSegmentLen
+	}
+
+	var n int
+	for _, c := range s {
+		n += size(c)
+	}
+	if n <= maxLen {
+		return s
+	}
+	if segments > 1 {
+		maxLen = segmentLen * segments
+	}
+
+	n = 0
+	for i, c := range s {
+		if n+size(c) > maxLen {
+			return strings.TrimSpace(s[:i])
+		}
+		n += size(c)
+	}
+	return s
+}
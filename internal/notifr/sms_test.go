@@ -0,0 +1,127 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateSMS(t *testing.T) {
+	testCases := []struct {
+		name     string
+		text     string
+		segments int
+		want     string
+	}{
+		{
+			name:     "short GSM text",
+			text:     strings.Repeat("a", 160),
+			segments: 1,
+			want:     strings.Repeat("a", 160),
+		},
+		{
+			name:     "long GSM text",
+			text:     strings.Repeat("a", 161),
+			segments: 1,
+			want:     strings.Repeat("a", 160),
+		},
+		{
+			name:     "GSM extension characters",
+			text:     strings.Repeat("{", 100),
+			segments: 1,
+			want:     strings.Repeat("{", 80),
+		},
+		{
+			name:     "several GSM segments",
+			text:     strings.Repeat("a", 400),
+			segments: 2,
+			want:     strings.Repeat("a", 306),
+		},
+		{
+			name:     "unicode text",
+			text:     strings.Repeat("я", 100),
+			segments: 1,
+			want:     strings.Repeat("я", 70),
+		},
+		{
+			name:     "several unicode segments",
+			text:     strings.Repeat("я", 200),
+			segments: 2,
+			want:     strings.Repeat("я", 134),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := truncateSMS(tc.text, tc.segments); got != tc.want {
+				t.Errorf("got text: %q; want text: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSMSSender(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read body: %s", err)
+		}
+		bodies = append(bodies, string(b))
+	}))
+	defer srv.Close()
+
+	cnf := SMSConfig{
+		GatewayURL:  srv.URL,
+		Method:      http.MethodPost,
+		Headers:     map[string]string{"Authorization": "Bearer test-token"},
+		ContentType: "application/json",
+		Segments:    1,
+		Retries:     []time.Duration{0},
+	}
+	if err := cnf.Body.Decode(`{"to": {{json .To}}, "text": {{json .Text}}}`); err != nil {
+		t.Fatalf("failed to decode body: %s", err)
+	}
+	msg := Message{Subject: "Alert", Text: "**Disk** is full, see [the dashboard](https://grafana.example.org)"}
+	if err := NewSMSSender(cnf).Send([]string{"+79999999999", "+79999999998"}, msg); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	want := []string{
+		`{"to": "+79999999999", "text": "Alert\nDisk is full, see the dashboard (https://grafana.example.org)"}`,
+		`{"to": "+79999999998", "text": "Alert\nDisk is full, see the dashboard (https://grafana.example.org)"}`,
+	}
+	if strings.Join(bodies, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got bodies: %q; want bodies: %q", bodies, want)
+	}
+}
+
+func TestSMSSenderConnectionError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	cnf := SMSConfig{GatewayURL: srv.URL + "/send?api_key=secret-key", Method: http.MethodPost, Segments: 1, Retries: []time.Duration{0}}
+	if err := cnf.Body.Decode(`{{json .Text}}`); err != nil {
+		t.Fatalf("failed to decode body: %s", err)
+	}
+	err := NewSMSSender(cnf).Send([]string{"+79999999999"}, Message{Text: "Test"})
+	if err == nil {
+		t.Fatal("got no error; want error")
+	}
+	if strings.Contains(err.Error(), "secret-key") {
+		t.Errorf("got error: %v; want error without the gateway URL", err)
+	}
+}
@@ -8,36 +8,147 @@ LICENSE file in the root directory of this source tree.
 package notifr
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"html/template"
+	"io/ioutil"
 	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/domodwyer/mailyak"
+	"github.com/domodwyer/mailyak/v3"
 	strip "github.com/grokify/html-strip-tags-go"
+	"github.com/pkg/errors"
 	blackfriday "github.com/russross/blackfriday/v2"
+	"golang.org/x/net/html"
 )
 
 // SMTPConfig is configuration for SMTP Relay connection.
 type SMTPConfig struct {
-	Host    string          `envconfig:"host" required:"true" desc:"a host of an SMTP relay"`
-	Port    int             `envconfig:"port" default:"587" desc:"a port of an SMTP relay"`
-	From    string          `envconfig:"from" desc:"a sender email address"`
-	Retries []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry email sending"`
+	Host            string                    `envconfig:"host" desc:"a host of an SMTP relay; it is required unless emails are delivered to MX servers"`
+	Port            int                       `envconfig:"port" default:"587" desc:"a port of an SMTP relay"`
+	From            string                    `envconfig:"from" desc:"a sender email address"`
+	Retries         []time.Duration           `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry email sending"`
+	Username        string                    `envconfig:"username" desc:"a username to authenticate on an SMTP relay; authentication is disabled when the username is empty"`
+	Password        string                    `envconfig:"password" json:"-" desc:"a password to authenticate on an SMTP relay"`
+	Auth            SMTPAuthMechanism         `envconfig:"auth" default:"plain" desc:"an SMTP authentication mechanism (plain, login, cram-md5, xoauth2)"`
+	OAuth2          OAuth2Config              `envconfig:"oauth2"`
+	Timeout         time.Duration             `envconfig:"timeout" default:"1m" desc:"a timeout of an SMTP session"`
+	TLS             bool                      `envconfig:"tls" default:"false" desc:"use implicit TLS (e.g. on port 465)"`
+	StartTLS        SMTPStartTLSPolicy        `envconfig:"starttls" default:"opportunistic" desc:"a STARTTLS policy (mandatory, opportunistic, disabled); ignored with implicit TLS"`
+	CAFile          string                    `envconfig:"ca_file" desc:"a path to a PEM file with CA certificates to verify an SMTP relay; system CAs are used when it is empty"`
+	CertFile        string                    `envconfig:"cert_file" desc:"a path to a PEM file with a client certificate"`
+	KeyFile         string                    `envconfig:"key_file" desc:"a path to a PEM file with a private key of a client certificate"`
+	ServerName      string                    `envconfig:"server_name" desc:"a server name to verify a certificate of an SMTP relay; the host is used when it is empty"`
+	DKIM            DKIMConfig                `envconfig:"dkim"`
+	Bounce          BounceConfig              `envconfig:"bounce"`
+	Mode            SMTPMode                  `envconfig:"mode" default:"to" desc:"a way to address recipients (to, bcc, separate)"`
+	TargetModes     map[string]SMTPMode       `envconfig:"target_modes" desc:"ways to address recipients by target names (<target>:<mode>,<target>:<mode>)"`
+	BccTo           string                    `envconfig:"bcc_to" desc:"a visible recipient of emails in the mode bcc; undisclosed recipients are shown when it is empty"`
+	AllowedHeaders  []string                  `envconfig:"allowed_headers" desc:"names of custom header fields that a message can set"`
+	MessageIDHost   string                    `envconfig:"message_id_host" desc:"a domain part of Message-ID header fields; the domain of the sender address is used when it is empty"`
+	Templates       SMTPTemplates             `envconfig:"templates" desc:"a path to a directory with HTML templates of emails (<name>.html)"`
+	Template        string                    `envconfig:"template" default:"default" desc:"a name of an HTML template of emails"`
+	TargetTemplates map[string]string         `envconfig:"target_templates" desc:"names of HTML templates of emails by target names (<target>:<template>,<target>:<template>)"`
+	InlineCSS       bool                      `envconfig:"inline_css" default:"true" desc:"move stylesheets of HTML templates to style attributes and adjust HTML for mail clients"`
+	MaxConns        int                       `envconfig:"max_conns" default:"10" desc:"a maximum number of open connections to an SMTP relay; the number is not limited when it is 0"`
+	MaxIdleConns    int                       `envconfig:"max_idle_conns" default:"2" desc:"a maximum number of idle connections to an SMTP relay that are kept for next emails"`
+	IdleTimeout     time.Duration             `envconfig:"idle_timeout" default:"30s" desc:"a time after which an idle connection to an SMTP relay is closed"`
+	LocalName       string                    `envconfig:"local_name" desc:"a host name in the EHLO command; when it is empty, localhost is used, or with MX delivery the machine's fully qualified host name or the sender's domain"`
+	MX              bool                      `envconfig:"mx" default:"false" desc:"deliver emails directly to MX servers of recipients' domains instead of an SMTP relay"`
+	MXPort          int                       `envconfig:"mx_port" default:"25" desc:"a port of MX servers"`
+	Resolver        string                    `envconfig:"resolver" desc:"an address of a DNS server to resolve MX records (<host>:<port>); the system resolver is used when it is empty"`
+	Keyring         SMTPKeyring               `envconfig:"keyring" desc:"a path to a directory with S/MIME certificates (*.pem, *.crt) and OpenPGP public keys (*.asc) of recipients"`
+	Encrypt         SMTPEncryption            `envconfig:"encrypt" default:"auto" desc:"a policy of encrypting emails (never, auto, always); auto encrypts emails to recipients that have keys in the keyring"`
+	TargetEncrypt   map[string]SMTPEncryption `envconfig:"target_encrypt" desc:"policies of encrypting emails by target names (<target>:<policy>,<target>:<policy>)"`
+	SMIMECertFile   string                    `envconfig:"smime_cert_file" desc:"a path to a PEM file with an S/MIME certificate (and its chain) to sign emails; emails are not signed with S/MIME when it is empty"`
+	SMIMEKeyFile    string                    `envconfig:"smime_key_file" desc:"a path to a PEM file with a private key of an S/MIME certificate"`
+	PGPKeyFile      string                    `envconfig:"pgp_key_file" desc:"a path to an armored OpenPGP private key to sign emails; emails are not signed with OpenPGP when it is empty"`
+	PGPPassphrase   string                    `envconfig:"pgp_passphrase" json:"-" desc:"a passphrase of an OpenPGP private key"`
 }
 
 // SMTPSender is a message sender that sends a message by SMTP.
 type SMTPSender struct {
 	SMTPConfig
-	sendfn func(*mailyak.MailYak) error
+	auth     smtp.Auth
+	pool     *smtpPool
+	resolver *net.Resolver
+	bounces  *Bounces
+	sendfn   func(from string, to []string, data []byte) error
 }
 
 // NewSMTPSender returns a new SMTPSender.
 func NewSMTPSender(cnf SMTPConfig) *SMTPSender {
-	return &SMTPSender{
+	s := &SMTPSender{
 		SMTPConfig: cnf,
-		sendfn:     func(mail *mailyak.MailYak) error { return mail.Send() },
+		auth:       newSMTPAuth(cnf),
+		resolver:   newResolver(cnf.Resolver),
+		bounces:    NewBounces(cnf.Bounce),
 	}
+	s.pool = newSMTPPool(cnf, s.dial)
+	s.sendfn = s.send
+	return s
+}
+
+// Bounces returns the bounce processor of the sender.
+func (s *SMTPSender) Bounces() *Bounces {
+	return s.bounces
+}
+
+// SMTPStartTLSPolicy is a policy of upgrading a connection to an SMTP relay with STARTTLS.
+type SMTPStartTLSPolicy string
+
+// Supported STARTTLS policies.
+const (
+	// StartTLSMandatory requires an SMTP relay to support STARTTLS.
+	StartTLSMandatory SMTPStartTLSPolicy = "mandatory"
+	// StartTLSOpportunistic upgrades a connection only if an SMTP relay supports STARTTLS.
+	StartTLSOpportunistic SMTPStartTLSPolicy = "opportunistic"
+	// StartTLSDisabled never upgrades a connection.
+	StartTLSDisabled SMTPStartTLSPolicy = "disabled"
+)
+
+// SMTPMode is a way to address recipients of an email.
+type SMTPMode string
+
+// Supported ways to address recipients.
+const (
+	// SMTPModeTo sends one email with all recipients in the header To.
+	SMTPModeTo SMTPMode = "to"
+	// SMTPModeBcc sends one email with all recipients as blind copies.
+	SMTPModeBcc SMTPMode = "bcc"
+	// SMTPModeSeparate sends a separate email to every recipient.
+	SMTPModeSeparate SMTPMode = "separate"
+)
+
+// Decode decodes a way to address recipients from its name.
+func (m *SMTPMode) Decode(value string) error {
+	switch v := SMTPMode(strings.ToLower(value)); v {
+	case SMTPModeTo, SMTPModeBcc, SMTPModeSeparate:
+		*m = v
+		return nil
+	}
+	return fmt.Errorf("unsupported SMTP mode %q", value)
+}
+
+// Decode decodes a STARTTLS policy from its name.
+func (p *SMTPStartTLSPolicy) Decode(value string) error {
+	switch v := SMTPStartTLSPolicy(strings.ToLower(value)); v {
+	case StartTLSMandatory, StartTLSOpportunistic, StartTLSDisabled:
+		*p = v
+		return nil
+	}
+	return fmt.Errorf("unsupported STARTTLS policy %q", value)
 }
 
 // Email header fields (including the Subject field) can be multi-line, with each line recommended to be no more than 78 characters.
@@ -45,60 +156,455 @@ func NewSMTPSender(cnf SMTPConfig) *SMTPSender {
 // More details about line length limits in the RFC 2822 (https://tools.ietf.org/html/rfc2822#section-2.1.1).
 const subjectMaxLen = 78
 
+// messageTitle returns a message's subject.
+// If the subject is empty, the function returns the first line of a message's text truncated to subjectMaxLen.
+func messageTitle(msg Message) string {
+	if msg.Subject != "" {
+		return msg.Subject
+	}
+	var title string
+	plainText := strip.StripTags(string(blackfriday.Run([]byte(msg.Text))))
+	for _, line := range strings.Split(plainText, "\n") {
+		if line != "" {
+			title = line
+			break
+		}
+	}
+	if len(title) > subjectMaxLen {
+		title = title[:subjectMaxLen]
+	}
+	return title
+}
+
 // Send sends a message by SMTP.
 // The method tries to re-send a message when the previous sending failed with a temporary network error.
+//
+// Recipients are addressed according to the mode of the message's target.
+// In the mode "separate", every recipient gets its own email that is retried independently,
+// and the returned error lists the recipients that the email was not delivered to.
+// The message's copy recipients are listed in the header Cc of every email, but they are added to the envelope
+// only until an email is delivered, so they get a single copy.
+//
+// Recipients that are disabled because of bounces are skipped.
 func (s *SMTPSender) Send(recipients []string, msg Message) error {
-	// These actions allow to correctly display the tables in the received emails, otherwise, without using CSS, the table frames are not displayed.
-	css := `<style>table,th,td{border: 1px solid black;} tr:nth-child(even){background-color: grey;}</style>`
-	md := string(blackfriday.Run([]byte(msg.Text)))
-	html := `
-<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
-<html xmlns="http://www.w3.org/1999/xhtml" xmlns:o="urn:schemas-microsoft-com:office:office">
-	<head>
-		<title>Message</title>` +
-		css +
-		`</head>
-	<body>` +
-		md +
-		`</body>
-</html>
-`
-
-	mail := mailyak.New(fmt.Sprintf("%s:%d", s.Host, s.Port), nil)
-
-	mail.To(recipients...)
-	if s.From != "" {
-		mail.From(s.From)
+	if recipients = s.bounces.filter(msg.Target, recipients); len(recipients) == 0 {
+		return fmt.Errorf("all recipients of target %q are disabled because of bounces", msg.Target)
+	}
+	cc, err := copyRecipients(msg)
+	if err != nil {
+		return err
 	}
-	subject := msg.Subject
-	if subject == "" {
-		plainText := strip.StripTags(md)
-		for _, line := range strings.Split(plainText, "\n") {
-			if line != "" {
-				subject = line
-				break
+	switch s.mode(msg.Target) {
+	case SMTPModeBcc:
+		to := s.BccTo
+		if to == "" {
+			to = smtpUndisclosedRecipients
+		}
+		return s.sendMail(msg, []string{to}, append(append([]string(nil), recipients...), cc...))
+	case SMTPModeSeparate:
+		return sendEach(recipients, msg, func(rcpt string) error {
+			if err := s.sendMail(msg, []string{rcpt}, append([]string{rcpt}, cc...)); err != nil {
+				return err
 			}
+			cc = nil
+			return nil
+		})
+	}
+	return s.sendMail(msg, recipients, append(append([]string(nil), recipients...), cc...))
+}
+
+// copyRecipients returns addresses of a message's copy recipients.
+func copyRecipients(msg Message) ([]string, error) {
+	var addrs []string
+	for _, cc := range msg.Cc {
+		addr, err := netmail.ParseAddress(cc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid copy recipient %q", cc)
 		}
-		if len(subject) > subjectMaxLen {
-			subject = subject[:subjectMaxLen]
+		addrs = append(addrs, addr.Address)
+	}
+	return addrs, nil
+}
+
+// smtpPriorities maps a message's priority to a value of the header field X-Priority.
+var smtpPriorities = map[string]string{
+	PriorityHigh:   "1 (Highest)",
+	PriorityNormal: "3 (Normal)",
+	PriorityLow:    "5 (Lowest)",
+}
+
+// smtpUndisclosedRecipients is an empty address group that is used as a visible recipient of a blind copy.
+const smtpUndisclosedRecipients = "undisclosed-recipients:;"
+
+// mode returns a way to address recipients of a target.
+func (s *SMTPSender) mode(target string) SMTPMode {
+	if mode, ok := s.TargetModes[target]; ok {
+		return mode
+	}
+	return s.Mode
+}
+
+// headerAllowed returns true if a message can set a custom header field with a specified name.
+func (s *SMTPSender) headerAllowed(name string) bool {
+	for _, allowed := range s.AllowedHeaders {
+		if strings.EqualFold(name, allowed) {
+			return true
 		}
 	}
-	mail.Subject(subject)
+	return false
+}
+
+// sendMail builds an email with the visible recipients in the header To and sends it to the envelope recipients.
+// The message's copy recipients are listed in the header Cc; the envelope recipients must include them to deliver a copy.
+func (s *SMTPSender) sendMail(msg Message, to, envelope []string) error {
+	html, err := s.renderHTML(msg)
+	if err != nil {
+		return err
+	}
+
+	mail := mailyak.New(net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), nil)
+
+	mail.To(to...)
+	if s.From != "" {
+		mail.From(s.From)
+	}
+	mail.Subject(messageTitle(msg))
+	if msg.ReplyTo != "" {
+		mail.ReplyTo(msg.ReplyTo)
+	}
+	if len(msg.Cc) != 0 {
+		mail.Cc(msg.Cc...)
+	}
+	// Header fields that are not allowed are skipped silently, so a message is delivered to other deliveries and recipients anyway.
+	for name, value := range msg.Headers {
+		if s.headerAllowed(name) {
+			mail.SetHeader(textproto.CanonicalMIMEHeaderKey(name), value)
+		}
+	}
+	if xp, ok := smtpPriorities[msg.Priority]; ok {
+		mail.SetHeader("X-Priority", xp)
+		mail.SetHeader("Importance", msg.Priority)
+	}
+	id, err := newMessageID(s.messageIDHost())
+	if err != nil {
+		return err
+	}
+	mail.SetHeader("Message-ID", id)
+	s.bounces.track(id, msg.Target, envelope)
+	if msg.Thread != "" {
+		root := threadMessageID(s.messageIDHost(), msg.Thread)
+		mail.SetHeader("In-Reply-To", root)
+		mail.SetHeader("References", root)
+	}
 	mail.Plain().Set(msg.Text)
 	mail.HTML().Set(html)
+	cids := cidReferences(html)
+	for _, a := range msg.Attachments {
+		r := bytes.NewReader(a.Content)
+		// An attachment is inline when the message's HTML refers to it, e.g. <img src="cid:chart.png">.
+		inline := cids[a.Filename]
+		switch {
+		case inline && a.ContentType != "":
+			mail.AttachInlineWithMimeType(a.Filename, r, a.ContentType)
+		case inline:
+			mail.AttachInline(a.Filename, r)
+		case a.ContentType != "":
+			mail.AttachWithMimeType(a.Filename, r, a.ContentType)
+		default:
+			mail.Attach(a.Filename, r)
+		}
+	}
 
-	var err error
-	for _, n := range s.Retries {
-		if err = s.sendfn(mail); err == nil {
-			break
+	buf, err := mail.MimeBuf()
+	if err != nil {
+		return errors.Wrap(err, "failed to build email")
+	}
+	mails := []securedMail{{to: envelope, data: buf.Bytes()}}
+	if s.needsSecuring(msg.Target, envelope) {
+		if mails, err = s.secure(msg.Target, envelope, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if len(mails) == 1 {
+		return s.deliver(mails[0].to, mails[0].data)
+	}
+	var errs sendErrors
+	for _, m := range mails {
+		if err := s.deliver(m.to, m.data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// cidReferences returns names of the parts that an HTML document refers to with "cid:" URLs.
+func cidReferences(doc string) map[string]bool {
+	refs := make(map[string]bool)
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return refs
+	}
+	walkHTML(root, func(n *html.Node) {
+		for _, a := range n.Attr {
+			if len(a.Val) < 4 || !strings.EqualFold(a.Val[:4], "cid:") {
+				continue
+			}
+			name := a.Val[4:]
+			if v, err := url.PathUnescape(name); err == nil {
+				name = v
+			}
+			refs[name] = true
 		}
-		if v, ok := err.(net.Error); !(ok && v.Temporary()) {
+	})
+	return refs
+}
+
+// deliver signs an email with DKIM if it is enabled and sends it to recipients.
+func (s *SMTPSender) deliver(to []string, data []byte) error {
+	if s.DKIM.KeyFile != "" {
+		var err error
+		if data, err = signDKIM(s.DKIM, data, time.Now()); err != nil {
 			return err
 		}
-		time.Sleep(n)
 	}
+	if s.MX {
+		return s.sendMX(to, data)
+	}
+	return retry(s.Retries, func() error { return s.sendfn(s.From, to, data) })
+}
+
+// helloName returns a host name of the EHLO command. An empty name means localhost.
+// MX servers often reject localhost, so in the MX mode the host name of the machine is used if it is fully qualified,
+// or the domain of the sender address otherwise.
+func (s *SMTPSender) helloName() string {
+	if s.LocalName != "" || !s.MX {
+		return s.LocalName
+	}
+	if host, err := os.Hostname(); err == nil && strings.Contains(host, ".") {
+		return host
+	}
+	if addr, err := netmail.ParseAddress(s.From); err == nil {
+		if i := strings.LastIndexByte(addr.Address, '@'); i != -1 {
+			return addr.Address[i+1:]
+		}
+	}
+	return ""
+}
+
+// messageIDHost returns a domain part of Message-ID header fields.
+func (s *SMTPSender) messageIDHost() string {
+	if s.MessageIDHost != "" {
+		return s.MessageIDHost
+	}
+	if addr, err := netmail.ParseAddress(s.From); err == nil {
+		if i := strings.LastIndexByte(addr.Address, '@'); i != -1 {
+			return addr.Address[i+1:]
+		}
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "localhost"
+}
+
+// newMessageID returns a unique Message-ID of an email (https://tools.ietf.org/html/rfc5322#section-3.6.4).
+func newMessageID(host string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate Message-ID")
+	}
+	return fmt.Sprintf("<%d.%x@%s>", time.Now().UnixNano(), b, host), nil
+}
+
+// threadMessageID returns a Message-ID of a thread's root that is derived from a thread key.
+// Emails of a thread refer to the root in the header fields In-Reply-To and References, so mail clients group them together.
+// No email has the root's Message-ID itself because mail clients hide emails with duplicated Message-IDs.
+func threadMessageID(host, thread string) string {
+	h := sha256.Sum256([]byte(thread))
+	return fmt.Sprintf("<thread.%x@%s>", h[:16], host)
+}
+
+// renderHTML renders an HTML part of an email with the template of the message's target.
+// Stylesheets of the rendered HTML are inlined if it is enabled, because several mail clients strip them.
+func (s *SMTPSender) renderHTML(msg Message) (string, error) {
+	name := s.Template
+	if v, ok := s.TargetTemplates[msg.Target]; ok {
+		name = v
+	}
+	if name == "" {
+		name = "default"
+	}
+	tmpl := s.Templates.lookup(name)
+	if tmpl == nil {
+		return "", fmt.Errorf("unknown email template %q", name)
+	}
+	data := smtpTemplateData{
+		Message: msg,
+		Subject: messageTitle(msg),
+		Body:    template.HTML(blackfriday.Run([]byte(msg.Text))),
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", errors.Wrapf(err, "failed to execute email template %q", name)
+	}
+	if !s.InlineCSS {
+		return sb.String(), nil
+	}
+	return inlineCSS(sb.String())
+}
+
+// send sends an email to an SMTP relay over a pooled connection.
+func (s *SMTPSender) send(from string, to []string, data []byte) error {
+	c, reused, err := s.pool.get()
+	if err != nil {
+		return err
+	}
+	err = sendSMTP(c.Client, from, to, data)
+	if _, ok := err.(*textproto.Error); err != nil && !ok && reused {
+		// A relay can close an idle connection at any moment, even right after it has accepted RSET,
+		// so an email that failed on a reused connection without a reply of the relay is sent once more over a new one.
+		if c, err = s.pool.redial(c); err != nil {
+			return err
+		}
+		err = sendSMTP(c.Client, from, to, data)
+	}
+	if err != nil {
+		// The state of the session is unknown after an error, so the connection is not reused.
+		s.pool.discard(c)
+		return err
+	}
+	s.pool.put(c)
+	return nil
+}
+
+// sendSMTP sends an email in an SMTP session.
+func sendSMTP(c *smtp.Client, from string, to []string, data []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
 	if err != nil {
 		return err
 	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Close closes idle connections to an SMTP relay.
+func (s *SMTPSender) Close() error {
+	s.pool.close()
 	return nil
 }
+
+// dial connects to an SMTP relay, establishes TLS according to the configuration and authenticates.
+func (s *SMTPSender) dial() (*smtpConn, error) {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return s.connect(s.Host, s.Port, s.TLS, tlsConfig, s.auth)
+}
+
+// connect connects to an SMTP server, establishes TLS and authenticates if auth is not nil.
+// The SMTP session must finish within the configured timeout.
+func (s *SMTPSender) connect(host string, port int, implicitTLS bool, tlsConfig *tls.Config, auth smtp.Auth) (*smtpConn, error) {
+	var (
+		addr   = net.JoinHostPort(host, strconv.Itoa(port))
+		dialer = &net.Dialer{Timeout: s.Timeout, Resolver: s.resolver}
+		conn   net.Conn
+		err    error
+	)
+	if implicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Timeout > 0 {
+		if err = conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if name := s.helloName(); name != "" {
+		if err = c.Hello(name); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if !implicitTLS {
+		if err = s.startTLS(c, tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, errors.New("SMTP relay does not support authentication")
+		}
+		if err = c.Auth(auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return &smtpConn{Client: c, conn: conn}, nil
+}
+
+// startTLS upgrades a connection with STARTTLS according to the STARTTLS policy.
+func (s *SMTPSender) startTLS(c *smtp.Client, tlsConfig *tls.Config) error {
+	if s.StartTLS == StartTLSDisabled {
+		return nil
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if s.StartTLS == StartTLSMandatory {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+		return nil
+	}
+	return c.StartTLS(tlsConfig)
+}
+
+// tlsConfig returns TLS configuration for a connection to an SMTP relay.
+// Certificates are loaded on every connection, so renewed certificates are used without a restart.
+func (s *SMTPSender) tlsConfig() (*tls.Config, error) {
+	cnf := &tls.Config{ServerName: s.ServerName}
+	if cnf.ServerName == "" {
+		cnf.ServerName = s.Host
+	}
+	if s.CAFile != "" {
+		b, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA certificates")
+		}
+		cnf.RootCAs = x509.NewCertPool()
+		if !cnf.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no CA certificates in %q", s.CAFile)
+		}
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		cnf.Certificates = []tls.Certificate{cert}
+	}
+	return cnf, nil
+}
@@ -0,0 +1,848 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSMTPAuth(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "test-refresh-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "test-token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	testCases := []struct {
+		name     string
+		cnf      SMTPConfig
+		wantMech string
+		wantErr  bool
+	}{
+		{
+			name: "without authentication",
+		},
+		{
+			name:     "plain",
+			cnf:      SMTPConfig{Username: "user", Password: "pass", Auth: SMTPAuthPlain},
+			wantMech: "PLAIN",
+		},
+		{
+			name:     "login",
+			cnf:      SMTPConfig{Username: "user", Password: "pass", Auth: SMTPAuthLogin},
+			wantMech: "LOGIN",
+		},
+		{
+			name:     "cram-md5",
+			cnf:      SMTPConfig{Username: "user", Password: "pass", Auth: SMTPAuthCRAMMD5},
+			wantMech: "CRAM-MD5",
+		},
+		{
+			name:     "xoauth2 with static token",
+			cnf:      SMTPConfig{Username: "user", Auth: SMTPAuthXOAuth2, OAuth2: OAuth2Config{Token: "test-token"}},
+			wantMech: "XOAUTH2",
+		},
+		{
+			name: "xoauth2 with refresh token",
+			cnf: SMTPConfig{Username: "user", Auth: SMTPAuthXOAuth2, OAuth2: OAuth2Config{
+				TokenURL:     tokenSrv.URL,
+				ClientID:     "client",
+				RefreshToken: "test-refresh-token",
+			}},
+			wantMech: "XOAUTH2",
+		},
+		{
+			name:    "invalid password",
+			cnf:     SMTPConfig{Username: "user", Password: "invalid", Auth: SMTPAuthPlain},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &testSMTPServer{username: "user", password: "pass", token: "test-token"}
+			srv.start(t)
+			defer srv.close()
+
+			cnf := tc.cnf
+			cnf.Host, cnf.Port = "127.0.0.1", srv.port()
+			cnf.From = "notifr@example.org"
+			cnf.Retries = []time.Duration{0}
+			err := NewSMTPSender(cnf).Send([]string{"email@example.org"}, Message{Subject: "Test", Text: "Test"})
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			mails := srv.messages()
+			if len(mails) != 1 {
+				t.Fatalf("got mails: %d; want mails: 1", len(mails))
+			}
+			if mails[0].mech != tc.wantMech {
+				t.Errorf("got mechanism: %q; want mechanism: %q", mails[0].mech, tc.wantMech)
+			}
+			if !strings.Contains(mails[0].data, "Subject: Test") {
+				t.Errorf("got mail: %q; want mail with subject %q", mails[0].data, "Test")
+			}
+		})
+	}
+}
+
+func TestSMTPTLS(t *testing.T) {
+	// The certificate of httptest's TLS server is self-signed for 127.0.0.1 and example.com,
+	// so it serves as a CA, as a server certificate and as a client certificate.
+	tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsSrv.Close()
+	cert := tlsSrv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := testWriteFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+	keyFile := testWriteFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})))
+
+	testCases := []struct {
+		name    string
+		srv     *testSMTPServer
+		cnf     SMTPConfig
+		wantTLS bool
+		wantErr bool
+	}{
+		{
+			name:    "opportunistic STARTTLS",
+			srv:     &testSMTPServer{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}},
+			cnf:     SMTPConfig{StartTLS: StartTLSOpportunistic, CAFile: certFile},
+			wantTLS: true,
+		},
+		{
+			name: "opportunistic STARTTLS without server support",
+			srv:  &testSMTPServer{},
+			cnf:  SMTPConfig{StartTLS: StartTLSOpportunistic, CAFile: certFile},
+		},
+		{
+			name:    "mandatory STARTTLS without server support",
+			srv:     &testSMTPServer{},
+			cnf:     SMTPConfig{StartTLS: StartTLSMandatory, CAFile: certFile},
+			wantErr: true,
+		},
+		{
+			name: "disabled STARTTLS",
+			srv:  &testSMTPServer{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}},
+			cnf:  SMTPConfig{StartTLS: StartTLSDisabled},
+		},
+		{
+			name:    "STARTTLS with unknown CA",
+			srv:     &testSMTPServer{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}},
+			cnf:     SMTPConfig{StartTLS: StartTLSMandatory},
+			wantErr: true,
+		},
+		{
+			name:    "implicit TLS with server name",
+			srv:     &testSMTPServer{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}, implicitTLS: true},
+			cnf:     SMTPConfig{TLS: true, CAFile: certFile, ServerName: "example.com"},
+			wantTLS: true,
+		},
+		{
+			name:    "implicit TLS with wrong server name",
+			srv:     &testSMTPServer{tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}, implicitTLS: true},
+			cnf:     SMTPConfig{TLS: true, CAFile: certFile, ServerName: "example.org"},
+			wantErr: true,
+		},
+		{
+			name: "client certificate",
+			srv: &testSMTPServer{tlsConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tls.RequireAnyClientCert,
+			}, implicitTLS: true},
+			cnf:     SMTPConfig{TLS: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+			wantTLS: true,
+		},
+		{
+			name: "without client certificate",
+			srv: &testSMTPServer{tlsConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tls.RequireAnyClientCert,
+			}, implicitTLS: true},
+			cnf:     SMTPConfig{TLS: true, CAFile: certFile},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.srv.start(t)
+			defer tc.srv.close()
+
+			cnf := tc.cnf
+			cnf.Host, cnf.Port = "127.0.0.1", tc.srv.port()
+			cnf.Timeout = time.Second
+			cnf.Retries = []time.Duration{0}
+			err := NewSMTPSender(cnf).Send([]string{"email@example.org"}, Message{Text: "Test"})
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			mails := tc.srv.messages()
+			if len(mails) != 1 {
+				t.Fatalf("got mails: %d; want mails: 1", len(mails))
+			}
+			if mails[0].tls != tc.wantTLS {
+				t.Errorf("got TLS: %t; want TLS: %t", mails[0].tls, tc.wantTLS)
+			}
+		})
+	}
+}
+
+// testSMTPServer is a fake SMTP server that supports the authentication mechanisms PLAIN, LOGIN, CRAM-MD5 and XOAUTH2.
+// If tlsConfig is not nil, the server supports STARTTLS, or implicit TLS when implicitTLS is true.
+// The first greylist RCPT commands are rejected temporarily as greylisting servers do,
+// and RCPT commands with the addresses listed in unknown are rejected permanently.
+// The first dropMail MAIL commands are not answered, and their connections are closed as if the server has dropped them.
+type testSMTPServer struct {
+	username, password, token string
+	tlsConfig                 *tls.Config
+	implicitTLS               bool
+	greylist                  int
+	unknown                   []string
+	dropMail                  int
+
+	ln net.Listener
+
+	mu     sync.Mutex
+	mails  []testMail
+	conns  []net.Conn
+	hellos []string
+}
+
+// testMail is a mail that a fake SMTP server has received.
+type testMail struct {
+	mech string
+	tls  bool
+	from string
+	to   []string
+	data string
+}
+
+func (s *testSMTPServer) start(t *testing.T) {
+	var err error
+	if s.implicitTLS {
+		s.ln, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+}
+
+func (s *testSMTPServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testSMTPServer) close() {
+	s.ln.Close()
+}
+
+// connections returns a number of accepted connections.
+func (s *testSMTPServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// closeConns closes all accepted connections as if a server dropped idle connections.
+func (s *testSMTPServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// helloNames returns host names of the EHLO and HELO commands.
+func (s *testSMTPServer) helloNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.hellos...)
+}
+
+func (s *testSMTPServer) messages() []testMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]testMail{}, s.mails...)
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var (
+		r    = bufio.NewReader(conn)
+		mail = testMail{tls: s.implicitTLS}
+	)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err == nil
+	}
+	readBase64 := func() (string, bool) {
+		line, ok := readLine()
+		b, err := base64.StdEncoding.DecodeString(line)
+		return string(b), ok && err == nil
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			s.mu.Lock()
+			s.hellos = append(s.hellos, arg)
+			s.mu.Unlock()
+			reply("250-localhost")
+			if s.tlsConfig != nil && !mail.tls {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2")
+		case "STARTTLS":
+			reply("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, mail = tlsConn, bufio.NewReader(tlsConn), testMail{tls: true}
+		case "AUTH":
+			mech, initial := arg, ""
+			if i := strings.IndexByte(arg, ' '); i != -1 {
+				mech, initial = arg[:i], arg[i+1:]
+			}
+			mech = strings.ToUpper(mech)
+			var ok bool
+			switch mech {
+			case "PLAIN":
+				b, err := base64.StdEncoding.DecodeString(initial)
+				ok = err == nil && string(b) == "\x00"+s.username+"\x00"+s.password
+			case "LOGIN":
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				username, _ := readBase64()
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				password, _ := readBase64()
+				ok = username == s.username && password == s.password
+			case "CRAM-MD5":
+				challenge := "<" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@localhost>"
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+				resp, _ := readBase64()
+				h := hmac.New(md5.New, []byte(s.password))
+				h.Write([]byte(challenge))
+				ok = resp == s.username+" "+hex.EncodeToString(h.Sum(nil))
+			case "XOAUTH2":
+				b, err := base64.StdEncoding.DecodeString(initial)
+				ok = err == nil && string(b) == "user="+s.username+"\x01auth=Bearer "+s.token+"\x01\x01"
+			}
+			if !ok {
+				reply("535 Authentication failed")
+				continue
+			}
+			mail.mech = mech
+			reply("235 Authentication succeeded")
+		case "MAIL":
+			s.mu.Lock()
+			dropped := s.dropMail > 0
+			if dropped {
+				s.dropMail--
+			}
+			s.mu.Unlock()
+			if dropped {
+				return
+			}
+			mail.from = arg
+			reply("250 OK")
+		case "RCPT":
+			s.mu.Lock()
+			greylisted := s.greylist > 0
+			if greylisted {
+				s.greylist--
+			}
+			s.mu.Unlock()
+			if greylisted {
+				reply("451 4.7.1 Greylisted, try again later")
+				continue
+			}
+			unknown := false
+			for _, addr := range s.unknown {
+				unknown = unknown || arg == "TO:<"+addr+">"
+			}
+			if unknown {
+				reply("550 5.1.1 No such user")
+				continue
+			}
+			mail.to = append(mail.to, arg)
+			reply("250 OK")
+		case "DATA":
+			reply("354 Start mail input")
+			var data strings.Builder
+			for {
+				line, ok := readLine()
+				if !ok {
+					return
+				}
+				if line == "." {
+					break
+				}
+				data.WriteString(line + "\n")
+			}
+			mail.data = data.String()
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			mail = testMail{mech: mail.mech, tls: mail.tls}
+			reply("250 OK")
+		case "RSET":
+			mail = testMail{mech: mail.mech, tls: mail.tls}
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPAttachments(t *testing.T) {
+	srv := &testSMTPServer{}
+	srv.start(t)
+	defer srv.close()
+
+	sender := NewSMTPSender(SMTPConfig{Host: "127.0.0.1", Port: srv.port(), Retries: []time.Duration{0}})
+	msg := Message{
+		Text: "Weekly report\n\n![chart](cid:chart.png)",
+		Attachments: []Attachment{
+			{Filename: "chart.png", ContentType: "image/png", Content: []byte("PNG")},
+			{Filename: "report.csv", Content: []byte("a,b\n")},
+		},
+	}
+	if err := sender.Send([]string{"email@example.org"}, msg); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	mails := srv.messages()
+	if len(mails) != 1 {
+		t.Fatalf("got mails: %d; want mails: 1", len(mails))
+	}
+	for _, want := range []string{
+		// The HTML part is encoded with quoted-printable.
+		`<img src=3D"cid:chart.png"`,
+		"Content-Type: image/png",
+		"Content-Disposition: inline;\n\tfilename=\"chart.png\"",
+		"Content-ID: <chart.png>",
+		"Content-Disposition: attachment;\n\tfilename=\"report.csv\"",
+		base64.StdEncoding.EncodeToString([]byte("a,b\n")),
+	} {
+		if !strings.Contains(mails[0].data, want) {
+			t.Errorf("got mail: %q; want mail that contains %q", mails[0].data, want)
+		}
+	}
+}
+
+func TestCIDReferences(t *testing.T) {
+	testCases := []struct {
+		name string
+		html string
+		want map[string]bool
+	}{
+		{
+			name: "image",
+			html: `<p><img src="cid:chart.png" alt="chart"></p>`,
+			want: map[string]bool{"chart.png": true},
+		},
+		{
+			name: "escaped name",
+			html: `<img src="CID:weekly%20chart.png">`,
+			want: map[string]bool{"weekly chart.png": true},
+		},
+		{
+			name: "name with a suffix",
+			html: `<img src="cid:chart.png.bak">`,
+			want: map[string]bool{"chart.png.bak": true},
+		},
+		{
+			name: "text only",
+			html: `<p>See cid:chart.png</p><code>cid:chart.png</code>`,
+			want: map[string]bool{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cidReferences(tc.html); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got references: %v; want references: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSMTPModes(t *testing.T) {
+	testCases := []struct {
+		name      string
+		cnf       SMTPConfig
+		cc        []string
+		wantMails []testMail
+	}{
+		{
+			name: "to",
+			cnf:  SMTPConfig{Mode: SMTPModeTo},
+			wantMails: []testMail{
+				{to: []string{"TO:<a@example.org>", "TO:<b@example.org>"}, data: "To: a@example.org,b@example.org"},
+			},
+		},
+		{
+			name: "bcc",
+			cnf:  SMTPConfig{Mode: SMTPModeBcc},
+			wantMails: []testMail{
+				{to: []string{"TO:<a@example.org>", "TO:<b@example.org>"}, data: "To: undisclosed-recipients:;"},
+			},
+		},
+		{
+			name: "bcc with visible recipient",
+			cnf:  SMTPConfig{Mode: SMTPModeBcc, BccTo: "ops@example.org"},
+			wantMails: []testMail{
+				{to: []string{"TO:<a@example.org>", "TO:<b@example.org>"}, data: "To: ops@example.org"},
+			},
+		},
+		{
+			name: "separate by target",
+			cnf:  SMTPConfig{Mode: SMTPModeTo, TargetModes: map[string]SMTPMode{"customers": SMTPModeSeparate}},
+			wantMails: []testMail{
+				{to: []string{"TO:<a@example.org>"}, data: "To: a@example.org"},
+				{to: []string{"TO:<b@example.org>"}, data: "To: b@example.org"},
+			},
+		},
+		{
+			name: "separate with copy",
+			cnf:  SMTPConfig{Mode: SMTPModeSeparate},
+			cc:   []string{"Support <support@example.org>"},
+			wantMails: []testMail{
+				{to: []string{"TO:<a@example.org>", "TO:<support@example.org>"}, data: "CC: Support <support@example.org>"},
+				{to: []string{"TO:<b@example.org>"}, data: "CC: Support <support@example.org>"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &testSMTPServer{}
+			srv.start(t)
+			defer srv.close()
+
+			cnf := tc.cnf
+			cnf.Host, cnf.Port = "127.0.0.1", srv.port()
+			cnf.Retries = []time.Duration{0}
+			msg := Message{Text: "Test", Target: "customers", Cc: tc.cc}
+			if err := NewSMTPSender(cnf).Send([]string{"a@example.org", "b@example.org"}, msg); err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+
+			mails := srv.messages()
+			if len(mails) != len(tc.wantMails) {
+				t.Fatalf("got mails: %d; want mails: %d", len(mails), len(tc.wantMails))
+			}
+			for i, want := range tc.wantMails {
+				if !reflect.DeepEqual(mails[i].to, want.to) {
+					t.Errorf("mail %d: got envelope recipients: %q; want envelope recipients: %q", i, mails[i].to, want.to)
+				}
+				if !strings.Contains(mails[i].data, "\n"+want.data+"\n") {
+					t.Errorf("mail %d: got mail: %q; want header: %q", i, mails[i].data, want.data)
+				}
+			}
+		})
+	}
+}
+
+func TestSMTPSeparateCopyAfterFailure(t *testing.T) {
+	srv := &testSMTPServer{unknown: []string{"a@example.org"}}
+	srv.start(t)
+	defer srv.close()
+
+	cnf := SMTPConfig{Host: "127.0.0.1", Port: srv.port(), Mode: SMTPModeSeparate, Retries: []time.Duration{0}}
+	msg := Message{Text: "Test", Cc: []string{"Support <support@example.org>"}}
+	err := NewSMTPSender(cnf).Send([]string{"a@example.org", "b@example.org", "c@example.org"}, msg)
+	if err == nil || !strings.Contains(err.Error(), `"a@example.org"`) {
+		t.Fatalf("got error: %v; want error of the first recipient", err)
+	}
+
+	mails := srv.messages()
+	wantTo := [][]string{
+		{"TO:<b@example.org>", "TO:<support@example.org>"},
+		{"TO:<c@example.org>"},
+	}
+	if len(mails) != len(wantTo) {
+		t.Fatalf("got mails: %d; want mails: %d", len(mails), len(wantTo))
+	}
+	for i, want := range wantTo {
+		if !reflect.DeepEqual(mails[i].to, want) {
+			t.Errorf("mail %d: got envelope recipients: %q; want envelope recipients: %q", i, mails[i].to, want)
+		}
+	}
+}
+
+func TestSMTPHeaders(t *testing.T) {
+	srv := &testSMTPServer{}
+	srv.start(t)
+	defer srv.close()
+
+	cnf := SMTPConfig{
+		Host:           "127.0.0.1",
+		Port:           srv.port(),
+		Retries:        []time.Duration{0},
+		AllowedHeaders: []string{"X-Ticket-ID"},
+	}
+	msg := Message{
+		Text:     "Test",
+		ReplyTo:  "helpdesk@example.org",
+		Cc:       []string{"Support <support@example.org>"},
+		Headers:  map[string]string{"x-ticket-id": "42", "X-Not-Allowed": "1"},
+		Priority: PriorityHigh,
+	}
+	if err := NewSMTPSender(cnf).Send([]string{"a@example.org"}, msg); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	mails := srv.messages()
+	if len(mails) != 1 {
+		t.Fatalf("got mails: %d; want mails: 1", len(mails))
+	}
+	if got, want := mails[0].to, []string{"TO:<a@example.org>", "TO:<support@example.org>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got envelope recipients: %q; want envelope recipients: %q", got, want)
+	}
+	for _, want := range []string{
+		"Reply-To: helpdesk@example.org",
+		"CC: Support <support@example.org>",
+		"X-Ticket-Id: 42",
+		"X-Priority: 1 (Highest)",
+		"Importance: high",
+	} {
+		if !strings.Contains(mails[0].data, "\n"+want+"\n") {
+			t.Errorf("got mail: %q; want header: %q", mails[0].data, want)
+		}
+	}
+	if strings.Contains(mails[0].data, "X-Not-Allowed") {
+		t.Errorf("got mail: %q; want no header %q", mails[0].data, "X-Not-Allowed")
+	}
+}
+
+func TestSMTPThread(t *testing.T) {
+	srv := &testSMTPServer{}
+	srv.start(t)
+	defer srv.close()
+
+	cnf := SMTPConfig{Host: "127.0.0.1", Port: srv.port(), From: "notifr@example.org", Retries: []time.Duration{0}}
+	s := NewSMTPSender(cnf)
+	for _, msg := range []Message{
+		{Text: "Firing", Thread: "incident-42"},
+		{Text: "Resolved", Thread: "incident-42"},
+	} {
+		if err := s.Send([]string{"a@example.org"}, msg); err != nil {
+			t.Fatalf("got error: %v; want no error", err)
+		}
+	}
+
+	mails := srv.messages()
+	if len(mails) != 2 {
+		t.Fatalf("got mails: %d; want mails: 2", len(mails))
+	}
+	root := threadMessageID("example.org", "incident-42")
+	if root == threadMessageID("example.org", "incident-43") {
+		t.Errorf("got the same Message-ID %q for different threads; want different Message-IDs", root)
+	}
+	reMessageID := regexp.MustCompile(`\nMessage-ID: (\S+)\n`)
+	var ids []string
+	for i, m := range mails {
+		header := m.data[:strings.Index(m.data, "\n\n")+1]
+		for _, want := range []string{"In-Reply-To: " + root, "References: " + root} {
+			if !strings.Contains(header, "\n"+want+"\n") {
+				t.Errorf("mail %d: got header: %q; want header field: %q", i, header, want)
+			}
+		}
+		id := reMessageID.FindStringSubmatch(header)
+		if id == nil {
+			t.Fatalf("mail %d: got header: %q; want header field Message-ID", i, header)
+		}
+		ids = append(ids, id[1])
+	}
+	if ids[0] == ids[1] || !strings.HasSuffix(ids[0], "@example.org>") {
+		t.Errorf("got Message-IDs: %q; want unique Message-IDs in the domain example.org", ids)
+	}
+}
+
+func TestSMTPPoolIdleTimeout(t *testing.T) {
+	srv := &testSMTPServer{}
+	srv.start(t)
+	defer srv.close()
+
+	cnf := SMTPConfig{
+		Host:         "127.0.0.1",
+		Port:         srv.port(),
+		Retries:      []time.Duration{0},
+		MaxIdleConns: 2,
+		IdleTimeout:  100 * time.Millisecond,
+	}
+	s := NewSMTPSender(cnf)
+	defer s.Close()
+	if err := s.Send([]string{"a@example.org"}, Message{Text: "Test"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	idle := func() int {
+		s.pool.mu.Lock()
+		defer s.pool.mu.Unlock()
+		return len(s.pool.idle)
+	}
+	if got := idle(); got != 1 {
+		t.Fatalf("got idle connections: %d; want idle connections: 1", got)
+	}
+	// An idle connection is closed after the timeout even if no email is sent.
+	waitFor(t, "closed idle connection", func() bool { return idle() == 0 })
+}
+
+func TestSMTPPool(t *testing.T) {
+	srv := &testSMTPServer{username: "user", password: "pass"}
+	srv.start(t)
+	defer srv.close()
+
+	cnf := SMTPConfig{
+		Host:         "127.0.0.1",
+		Port:         srv.port(),
+		Username:     "user",
+		Password:     "pass",
+		Auth:         SMTPAuthLogin,
+		Retries:      []time.Duration{0},
+		MaxConns:     2,
+		MaxIdleConns: 2,
+	}
+	s := NewSMTPSender(cnf)
+	defer s.Close()
+	send := func() {
+		if err := s.Send([]string{"a@example.org"}, Message{Text: "Test"}); err != nil {
+			t.Fatalf("got error: %v; want no error", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		send()
+	}
+	if got := srv.connections(); got != 1 {
+		t.Errorf("got connections: %d; want connections: 1", got)
+	}
+
+	// A connection is dialed again without retries when a relay has closed an idle connection.
+	srv.closeConns()
+	send()
+	if got := srv.connections(); got != 2 {
+		t.Errorf("got connections: %d; want connections: 2", got)
+	}
+
+	// An email is sent again over a new connection when a relay drops a reused connection in the middle of a session.
+	srv.mu.Lock()
+	srv.dropMail = 1
+	srv.mu.Unlock()
+	send()
+	if got := srv.connections(); got != 3 {
+		t.Errorf("got connections: %d; want connections: 3", got)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Send([]string{"a@example.org"}, Message{Text: "Test"}); err != nil {
+				t.Errorf("got error: %v; want no error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := srv.connections(); got > 5 {
+		t.Errorf("got connections: %d; want at most 5 connections", got)
+	}
+
+	mails := srv.messages()
+	if len(mails) != 15 {
+		t.Fatalf("got mails: %d; want mails: 15", len(mails))
+	}
+	for i, m := range mails {
+		if m.mech != "LOGIN" {
+			t.Errorf("mail %d: got mechanism: %q; want mechanism: %q", i, m.mech, "LOGIN")
+		}
+	}
+}
+
+func TestSMTPPoolWaitTimeout(t *testing.T) {
+	p := newSMTPPool(SMTPConfig{MaxConns: 1, Timeout: 50 * time.Millisecond}, func() (*smtpConn, error) {
+		return &smtpConn{}, nil
+	})
+	if _, _, err := p.get(); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	// The only connection is busy.
+	if _, _, err := p.get(); !isTemporary(err) {
+		t.Fatalf("got error: %v; want temporary error", err)
+	}
+	p.release()
+	if _, _, err := p.get(); err != nil {
+		t.Fatalf("got error: %v; want no error after the connection is released", err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SMTPAuthMechanism is an SMTP authentication mechanism.
+type SMTPAuthMechanism string
+
+// Supported SMTP authentication mechanisms.
+const (
+	SMTPAuthPlain   SMTPAuthMechanism = "plain"
+	SMTPAuthLogin   SMTPAuthMechanism = "login"
+	SMTPAuthCRAMMD5 SMTPAuthMechanism = "cram-md5"
+	SMTPAuthXOAuth2 SMTPAuthMechanism = "xoauth2"
+)
+
+// Decode decodes an SMTP authentication mechanism from its name.
+func (m *SMTPAuthMechanism) Decode(value string) error {
+	switch v := SMTPAuthMechanism(strings.ToLower(value)); v {
+	case SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5, SMTPAuthXOAuth2:
+		*m = v
+		return nil
+	}
+	return fmt.Errorf("unsupported SMTP authentication mechanism %q", value)
+}
+
+// OAuth2Config is configuration for getting OAuth2 access tokens.
+// If a static token is not specified, tokens are requested from a token endpoint
+// with the refresh token grant, or with the client credentials grant when a refresh token is empty.
+type OAuth2Config struct {
+	Token        string   `envconfig:"token" json:"-" desc:"a static OAuth2 access token"`
+	TokenURL     string   `envconfig:"token_url" desc:"a URL of an OAuth2 token endpoint"`
+	ClientID     string   `envconfig:"client_id" desc:"an OAuth2 client ID"`
+	ClientSecret string   `envconfig:"client_secret" json:"-" desc:"an OAuth2 client secret"`
+	RefreshToken string   `envconfig:"refresh_token" json:"-" desc:"an OAuth2 refresh token"`
+	Scopes       []string `envconfig:"scopes" desc:"OAuth2 scopes of access tokens"`
+}
+
+// newSMTPAuth returns an SMTP authentication for a mechanism.
+// The function returns nil if a username is empty.
+func newSMTPAuth(cnf SMTPConfig) smtp.Auth {
+	if cnf.Username == "" {
+		return nil
+	}
+	switch cnf.Auth {
+	case SMTPAuthLogin:
+		return &loginAuth{username: cnf.Username, password: cnf.Password, host: cnf.Host}
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(cnf.Username, cnf.Password)
+	case SMTPAuthXOAuth2:
+		return &xoauth2Auth{username: cnf.Username, tokens: newOAuth2TokenSource(cnf.OAuth2)}
+	}
+	return smtp.PlainAuth("", cnf.Username, cnf.Password, cnf.Host)
+}
+
+// loginAuth implements the LOGIN authentication mechanism (https://tools.ietf.org/html/draft-murchison-sasl-login-00).
+// Like smtp.PlainAuth, it sends credentials only over TLS connections or to localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 authentication mechanism (https://developers.google.com/gmail/imap/xoauth2-protocol).
+type xoauth2Auth struct {
+	username string
+	tokens   *oauth2TokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	token, err := a.tokens.token()
+	if err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sends an error description and expects an empty response to finish the exchange.
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// oauth2TokenSource returns OAuth2 access tokens and caches them until they expire.
+type oauth2TokenSource struct {
+	OAuth2Config
+	client *http.Client
+
+	mu     sync.Mutex
+	cached string
+	expiry time.Time
+}
+
+func newOAuth2TokenSource(cnf OAuth2Config) *oauth2TokenSource {
+	return &oauth2TokenSource{OAuth2Config: cnf, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// oauth2ExpiryDelta is a time before the expiration of a token when the token is refreshed.
+const oauth2ExpiryDelta = time.Minute
+
+// token returns a valid access token.
+func (s *oauth2TokenSource) token() (string, error) {
+	if s.Token != "" {
+		return s.Token, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != "" && time.Now().Add(oauth2ExpiryDelta).Before(s.expiry) {
+		return s.cached, nil
+	}
+
+	form := url.Values{"client_id": {s.ClientID}, "client_secret": {s.ClientSecret}}
+	if s.RefreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(s.Scopes) != 0 {
+		form.Set("scope", strings.Join(s.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = doHTTP(s.client, req, &resp); err != nil {
+		return "", errors.Wrap(err, "failed to get OAuth2 token")
+	}
+	if resp.AccessToken == "" {
+		return "", errors.New("failed to get OAuth2 token: empty access token")
+	}
+	s.cached, s.expiry = resp.AccessToken, time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second)
+	return s.cached, nil
+}
@@ -0,0 +1,517 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+func init() {
+	// The package pkcs7 uses DES by default, which is insecure.
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// SMTPEncryption is a policy of encrypting emails.
+type SMTPEncryption string
+
+// Supported policies of encrypting emails.
+const (
+	// EncryptNever never encrypts emails.
+	EncryptNever SMTPEncryption = "never"
+	// EncryptAuto encrypts emails to recipients that have keys in the keyring, and sends plain emails to other recipients.
+	EncryptAuto SMTPEncryption = "auto"
+	// EncryptAlways encrypts emails to all recipients, and fails for recipients that have no keys in the keyring.
+	EncryptAlways SMTPEncryption = "always"
+)
+
+// Decode decodes a policy of encrypting emails from its name.
+func (e *SMTPEncryption) Decode(value string) error {
+	switch v := SMTPEncryption(strings.ToLower(value)); v {
+	case EncryptNever, EncryptAuto, EncryptAlways:
+		*e = v
+		return nil
+	}
+	return fmt.Errorf("unsupported encryption policy %q", value)
+}
+
+// SMTPKeyring is a set of S/MIME certificates and OpenPGP public keys of recipients.
+// The keyring is loaded from a directory with PEM files of S/MIME certificates (*.pem, *.crt)
+// and armored OpenPGP public keys (*.asc). Certificates and keys are found by the email addresses that they contain.
+type SMTPKeyring struct {
+	dir   string
+	certs map[string]*x509.Certificate
+	keys  map[string]*openpgp.Entity
+}
+
+// Decode loads a keyring from a directory.
+func (k *SMTPKeyring) Decode(value string) error {
+	if value == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(value)
+	if err != nil {
+		return errors.Wrap(err, "failed to read keyring")
+	}
+	keyring := SMTPKeyring{dir: value, certs: make(map[string]*x509.Certificate), keys: make(map[string]*openpgp.Entity)}
+	for _, fi := range files {
+		path := filepath.Join(value, fi.Name())
+		switch strings.ToLower(filepath.Ext(fi.Name())) {
+		case ".pem", ".crt":
+			err = keyring.loadCerts(path)
+		case ".asc":
+			err = keyring.loadKeys(path)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to load keyring file %q", path)
+		}
+	}
+	*k = keyring
+	return nil
+}
+
+func (k *SMTPKeyring) loadCerts(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		for _, email := range cert.EmailAddresses {
+			k.certs[strings.ToLower(email)] = cert
+		}
+	}
+	return nil
+}
+
+func (k *SMTPKeyring) loadKeys(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return err
+	}
+	for _, e := range entities {
+		for _, id := range e.Identities {
+			if id.UserId != nil && id.UserId.Email != "" {
+				k.keys[strings.ToLower(id.UserId.Email)] = e
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON serializes SMTPKeyring to the path of the keyring's directory.
+func (k SMTPKeyring) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.dir)
+}
+
+// securedMail is an email that is encrypted or signed for a group of recipients.
+type securedMail struct {
+	to   []string
+	data []byte
+}
+
+// encryption returns a policy of encrypting emails of a target.
+func (s *SMTPSender) encryption(target string) SMTPEncryption {
+	if e, ok := s.TargetEncrypt[target]; ok {
+		return e
+	}
+	if s.Encrypt == "" {
+		return EncryptNever
+	}
+	return s.Encrypt
+}
+
+// needsSecuring reports whether an email to recipients must be signed or encrypted.
+// Emails that need neither are sent exactly as they are built.
+func (s *SMTPSender) needsSecuring(target string, to []string) bool {
+	if s.SMIMECertFile != "" || s.PGPKeyFile != "" {
+		return true
+	}
+	switch s.encryption(target) {
+	case EncryptNever:
+		return false
+	case EncryptAlways:
+		return true
+	}
+	for _, rcpt := range to {
+		email := strings.ToLower(rcpt)
+		if s.Keyring.certs[email] != nil || s.Keyring.keys[email] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// secure encrypts and signs an email according to the configuration.
+// Recipients are grouped by the format of their keys: every group gets its own email that is encrypted for all of its recipients.
+// An encrypted email carries its header fields inside the encrypted part as protected headers, and its outer Subject is a placeholder.
+// In the mode "bcc", every recipient gets its own encrypted email because an encrypted email lists the keys of all of its recipients.
+// The function returns errors for recipients that must get encrypted emails but have no keys.
+func (s *SMTPSender) secure(target string, to []string, data []byte) ([]securedMail, error) {
+	var (
+		policy                  = s.encryption(target)
+		plainTo, smimeTo, pgpTo []string
+		certs                   []*x509.Certificate
+		keys                    openpgp.EntityList
+		errs                    sendErrors
+	)
+	for _, rcpt := range to {
+		email := strings.ToLower(rcpt)
+		cert, key := s.Keyring.certs[email], s.Keyring.keys[email]
+		switch {
+		case policy == EncryptNever:
+			plainTo = append(plainTo, rcpt)
+		case cert != nil:
+			smimeTo, certs = append(smimeTo, rcpt), append(certs, cert)
+		case key != nil:
+			pgpTo, keys = append(pgpTo, rcpt), append(keys, key)
+		case policy == EncryptAlways:
+			errs = append(errs, fmt.Errorf("recipient %q: no S/MIME certificate or OpenPGP key to encrypt email", rcpt))
+		default:
+			plainTo = append(plainTo, rcpt)
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	header, entity := splitEntity(crlf(data))
+	var mails []securedMail
+	if len(plainTo) != 0 {
+		signed, err := s.sign(entity)
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, securedMail{to: plainTo, data: append(header, signed...)})
+	}
+	outer, inner := protectHeaders(header, entity)
+	hidden := s.mode(target) == SMTPModeBcc
+	if len(smimeTo) != 0 {
+		signed, err := s.smimeSign(inner)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range encryptionGroups(len(smimeTo), hidden) {
+			encrypted, err := smimeEncrypt(signed, certs[g[0]:g[1]])
+			if err != nil {
+				return nil, err
+			}
+			mails = append(mails, securedMail{to: smimeTo[g[0]:g[1]], data: concat(outer, encrypted)})
+		}
+	}
+	for _, g := range encryptionGroups(len(pgpTo), hidden) {
+		encrypted, err := s.pgpEncrypt(inner, keys[g[0]:g[1]])
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, securedMail{to: pgpTo[g[0]:g[1]], data: concat(outer, encrypted)})
+	}
+	return mails, nil
+}
+
+// encryptionGroups splits n recipients of an encrypted email to groups that get their own emails.
+// A group is a range [from, to) of the recipients' indexes. When the recipients are hidden, every recipient is a group.
+func encryptionGroups(n int, hidden bool) [][2]int {
+	if n == 0 {
+		return nil
+	}
+	if !hidden {
+		return [][2]int{{0, n}}
+	}
+	groups := make([][2]int, n)
+	for i := range groups {
+		groups[i] = [2]int{i, i + 1}
+	}
+	return groups
+}
+
+// smtpOuterHeaders are the header fields that stay in clear text in encrypted emails because they are needed to deliver
+// and display the emails. Other header fields are protected.
+var smtpOuterHeaders = map[string]bool{
+	"from":         true,
+	"to":           true,
+	"reply-to":     true,
+	"date":         true,
+	"message-id":   true,
+	"mime-version": true,
+}
+
+// smtpProtectedSubject is a placeholder of the outer Subject of encrypted emails
+// (https://tools.ietf.org/html/draft-autocrypt-lamps-protected-headers-02#section-4.2).
+const smtpProtectedSubject = "..."
+
+// protectHeaders moves the header fields of an email that are not needed for delivery into its MIME entity
+// as protected headers (https://tools.ietf.org/html/draft-autocrypt-lamps-protected-headers-02),
+// and returns the outer header fields with a placeholder Subject, and the entity with the protected headers.
+func protectHeaders(header, entity []byte) ([]byte, []byte) {
+	var outer, inner bytes.Buffer
+	for _, field := range splitHeaderFields(string(header)) {
+		name := strings.ToLower(headerFieldName(field))
+		if smtpOuterHeaders[name] {
+			outer.WriteString(field)
+			continue
+		}
+		if name == "subject" {
+			outer.WriteString("Subject: " + smtpProtectedSubject + "\r\n")
+		}
+		inner.WriteString(field)
+	}
+	// The body keeps the empty line that separates it from the content header fields.
+	contentHeader, body := []byte{}, entity
+	if i := bytes.Index(entity, []byte("\r\n\r\n")); i != -1 && !bytes.HasPrefix(entity, []byte("\r\n")) {
+		contentHeader, body = entity[:i+2], entity[i+2:]
+	}
+	for _, field := range splitHeaderFields(string(contentHeader)) {
+		if strings.EqualFold(headerFieldName(field), "Content-Type") {
+			field = strings.TrimSuffix(field, "\r\n") + "; protected-headers=\"v1\"\r\n"
+		}
+		inner.WriteString(field)
+	}
+	inner.Write(body)
+	return outer.Bytes(), inner.Bytes()
+}
+
+// concat returns a new slice with the contents of a and b, so that appending never modifies a shared array.
+func concat(a, b []byte) []byte {
+	return append(append(make([]byte, 0, len(a)+len(b)), a...), b...)
+}
+
+// sign signs a MIME entity of an unencrypted email with S/MIME if an S/MIME certificate is configured,
+// or with OpenPGP if an OpenPGP key is configured. Otherwise, the function returns the entity as is.
+func (s *SMTPSender) sign(entity []byte) ([]byte, error) {
+	if s.SMIMECertFile != "" {
+		return s.smimeSign(entity)
+	}
+	if s.PGPKeyFile != "" {
+		return s.pgpSign(entity)
+	}
+	return entity, nil
+}
+
+// smimeSign signs a MIME entity with S/MIME (https://tools.ietf.org/html/rfc8551#section-3.5.3).
+// If no S/MIME certificate is configured, the function returns the entity as is.
+func (s *SMTPSender) smimeSign(entity []byte) ([]byte, error) {
+	if s.SMIMECertFile == "" {
+		return entity, nil
+	}
+	pair, err := tls.LoadX509KeyPair(s.SMIMECertFile, s.SMIMEKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load S/MIME certificate")
+	}
+	var chain []*x509.Certificate
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse S/MIME certificate")
+		}
+		chain = append(chain, cert)
+	}
+	sd, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err = sd.AddSignerChain(chain[0], pair.PrivateKey, chain[1:], pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, errors.Wrap(err, "failed to sign email with S/MIME")
+	}
+	sd.Detach()
+	sig, err := sd.Finish()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign email with S/MIME")
+	}
+	return multipartSigned(entity, `protocol="application/pkcs7-signature"; micalg=sha-256`,
+		"Content-Type: application/pkcs7-signature; name=smime.p7s\r\n"+
+			"Content-Disposition: attachment; filename=smime.p7s\r\n"+
+			"Content-Transfer-Encoding: base64\r\n\r\n"+base64Lines(sig))
+}
+
+// smimeEncrypt encrypts a MIME entity with S/MIME for recipients' certificates (https://tools.ietf.org/html/rfc8551#section-3.3).
+func smimeEncrypt(entity []byte, certs []*x509.Certificate) ([]byte, error) {
+	b, err := pkcs7.Encrypt(entity, certs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt email with S/MIME")
+	}
+	return []byte("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n" +
+		"Content-Disposition: attachment; filename=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" + base64Lines(b)), nil
+}
+
+// pgpSigner loads an OpenPGP private key to sign emails. The function returns nil if no key is configured.
+func (s *SMTPSender) pgpSigner() (*openpgp.Entity, error) {
+	if s.PGPKeyFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(s.PGPKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read OpenPGP key")
+	}
+	defer f.Close()
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse OpenPGP key")
+	}
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, fmt.Errorf("no OpenPGP private key in %q", s.PGPKeyFile)
+	}
+	signer := entities[0]
+	if signer.PrivateKey.Encrypted {
+		if err = signer.PrivateKey.Decrypt([]byte(s.PGPPassphrase)); err != nil {
+			return nil, errors.Wrap(err, "failed to decrypt OpenPGP key")
+		}
+	}
+	return signer, nil
+}
+
+// pgpConfig is configuration of OpenPGP signatures and encryption.
+var pgpConfig = &packet.Config{DefaultHash: crypto.SHA256, DefaultCipher: packet.CipherAES256}
+
+// pgpSign signs a MIME entity with OpenPGP (https://tools.ietf.org/html/rfc3156#section-5).
+func (s *SMTPSender) pgpSign(entity []byte) ([]byte, error) {
+	signer, err := s.pgpSigner()
+	if err != nil {
+		return nil, err
+	}
+	var sig bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(entity), pgpConfig); err != nil {
+		return nil, errors.Wrap(err, "failed to sign email with OpenPGP")
+	}
+	return multipartSigned(entity, `protocol="application/pgp-signature"; micalg=pgp-sha256`,
+		"Content-Type: application/pgp-signature; name=signature.asc\r\n\r\n"+crlfString(sig.String()))
+}
+
+// pgpEncrypt encrypts a MIME entity with OpenPGP for recipients' keys (https://tools.ietf.org/html/rfc3156#section-4).
+// The entity is signed in the same OpenPGP message if an OpenPGP key is configured.
+func (s *SMTPSender) pgpEncrypt(entity []byte, keys openpgp.EntityList) ([]byte, error) {
+	signer, err := s.pgpSigner()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	aw, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(aw, keys, signer, &openpgp.FileHints{IsBinary: true}, pgpConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt email with OpenPGP")
+	}
+	if _, err = w.Write(entity); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	if err = aw.Close(); err != nil {
+		return nil, err
+	}
+	boundary, err := newBoundary()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=%q\r\n\r\n", boundary) +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/octet-stream; name=encrypted.asc\r\n\r\n" + crlfString(buf.String()) + "\r\n" +
+		"--" + boundary + "--\r\n"), nil
+}
+
+// multipartSigned returns a multipart/signed entity with a signed entity and its signature.
+func multipartSigned(entity []byte, params, signature string) ([]byte, error) {
+	boundary, err := newBoundary()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Content-Type: multipart/signed; %s; boundary=%q\r\n\r\n", params, boundary)
+	buf.WriteString("--" + boundary + "\r\n")
+	buf.Write(entity)
+	// The CRLF before a boundary belongs to the boundary, so it is not signed (https://tools.ietf.org/html/rfc2046#section-5.1.1).
+	buf.WriteString("\r\n--" + boundary + "\r\n")
+	buf.WriteString(signature)
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+	return buf.Bytes(), nil
+}
+
+// splitEntity splits an email with CRLF line endings to the header fields of the message
+// and a MIME entity that consists of the content header fields (Content-*) and the body.
+func splitEntity(data []byte) ([]byte, []byte) {
+	header, body := data, []byte{}
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i != -1 {
+		header, body = data[:i+2], data[i+4:]
+	}
+	var msgHeader, entity bytes.Buffer
+	for _, field := range splitHeaderFields(string(header)) {
+		if strings.HasPrefix(strings.ToLower(headerFieldName(field)), "content-") {
+			entity.WriteString(field)
+		} else {
+			msgHeader.WriteString(field)
+		}
+	}
+	entity.WriteString("\r\n")
+	entity.Write(body)
+	return msgHeader.Bytes(), entity.Bytes()
+}
+
+func newBoundary() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate MIME boundary")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// base64Lines encodes data to base64 with lines of 76 characters (https://tools.ietf.org/html/rfc2045#section-6.8).
+func base64Lines(b []byte) string {
+	s := base64.StdEncoding.EncodeToString(b)
+	var sb strings.Builder
+	for len(s) > 76 {
+		sb.WriteString(s[:76] + "\r\n")
+		s = s[76:]
+	}
+	sb.WriteString(s + "\r\n")
+	return sb.String()
+}
+
+// crlf converts line endings of data to CRLF.
+func crlf(data []byte) []byte {
+	return bytes.Replace(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+}
+
+func crlfString(s string) string {
+	return string(crlf([]byte(s)))
+}
@@ -0,0 +1,333 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"go.mozilla.org/pkcs7"
+)
+
+func TestSMTPEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rcptCert, rcptKey := testSMIMECert(t, "SMIME@example.org")
+	signerCert, signerKey := testSMIMECert(t, "notifr@example.org")
+	writeFile := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	writeFile("smime.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rcptCert.Raw}))
+	signerCertFile := testWriteFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signerCert.Raw})))
+	signerKeyFile := testWriteFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(signerKey)})))
+
+	writePGPKey := func(name, email string) *openpgp.Entity {
+		entity, err := openpgp.NewEntity("PGP", "", email, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var key bytes.Buffer
+		w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = entity.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		writeFile(name, key.Bytes())
+		return entity
+	}
+	pgpEntities := map[string]*openpgp.Entity{
+		"pgp":  writePGPKey("pgp.asc", "pgp@example.org"),
+		"pgp2": writePGPKey("pgp2.asc", "pgp2@example.org"),
+	}
+
+	var keyring SMTPKeyring
+	if err = keyring.Decode(dir); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	testCases := []struct {
+		name     string
+		cnf      SMTPConfig
+		to       []string
+		wantErr  bool
+		wantMail map[string]string
+	}{
+		{
+			name: "auto",
+			cnf:  SMTPConfig{Encrypt: EncryptAuto},
+			to:   []string{"smime@example.org", "pgp@example.org", "plain@example.org"},
+			wantMail: map[string]string{
+				"smime@example.org": "smime",
+				"pgp@example.org":   "pgp",
+				"plain@example.org": "plain",
+			},
+		},
+		{
+			name:     "auto with signature",
+			cnf:      SMTPConfig{Encrypt: EncryptAuto, SMIMECertFile: signerCertFile, SMIMEKeyFile: signerKeyFile},
+			to:       []string{"smime@example.org", "plain@example.org"},
+			wantMail: map[string]string{"smime@example.org": "signed smime", "plain@example.org": "signed"},
+		},
+		{
+			name:     "target policy",
+			cnf:      SMTPConfig{Encrypt: EncryptAlways, TargetEncrypt: map[string]SMTPEncryption{"test": EncryptNever}},
+			to:       []string{"smime@example.org", "plain@example.org"},
+			wantMail: map[string]string{"smime@example.org,plain@example.org": "plain"},
+		},
+		{
+			name:     "to with several keys",
+			cnf:      SMTPConfig{Encrypt: EncryptAuto, Mode: SMTPModeTo},
+			to:       []string{"pgp@example.org", "pgp2@example.org"},
+			wantMail: map[string]string{"pgp@example.org,pgp2@example.org": "pgp"},
+		},
+		{
+			name:     "bcc with several keys",
+			cnf:      SMTPConfig{Encrypt: EncryptAuto, Mode: SMTPModeBcc},
+			to:       []string{"pgp@example.org", "pgp2@example.org"},
+			wantMail: map[string]string{"pgp@example.org": "pgp", "pgp2@example.org": "pgp2"},
+		},
+		{
+			name:    "always without key",
+			cnf:     SMTPConfig{Encrypt: EncryptAlways},
+			to:      []string{"smime@example.org", "plain@example.org"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cnf.From, tc.cnf.Keyring, tc.cnf.Retries = "notifr@example.org", keyring, []time.Duration{0}
+			s := NewSMTPSender(tc.cnf)
+			got := make(map[string]string)
+			s.sendfn = func(from string, to []string, data []byte) error {
+				got[strings.Join(to, ",")] = string(data)
+				return nil
+			}
+			err := s.Send(tc.to, Message{Subject: "Disk is full", Text: "Firing", Target: "test", Priority: PriorityHigh, Thread: "disk"})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if len(got) != len(tc.wantMail) {
+				t.Fatalf("got mails: %d; want mails: %d", len(got), len(tc.wantMail))
+			}
+			for to, kind := range tc.wantMail {
+				mail, ok := got[to]
+				if !ok {
+					t.Fatalf("got no mail to %q; want mail", to)
+				}
+				header, entity := splitEntity([]byte(mail))
+				if !strings.Contains(string(header), "Subject: ") || strings.Contains(string(header), "Content-Type") {
+					t.Errorf("mail to %q: got header: %q; want message header fields only", to, header)
+				}
+				var content []byte
+				switch kind {
+				case "plain":
+					if !strings.Contains(string(entity), "Firing") {
+						t.Errorf("mail to %q: got entity: %q; want plain text", to, entity)
+					}
+				case "signed":
+					testVerifySMIME(t, entity)
+				case "smime", "signed smime":
+					content = testDecryptSMIME(t, entity, rcptCert, rcptKey)
+					if kind == "signed smime" {
+						content = testVerifySMIME(t, content)
+					}
+				case "pgp", "pgp2":
+					content = testDecryptPGP(t, entity, pgpEntities[kind])
+				}
+				if content == nil {
+					continue
+				}
+				// Header fields of an encrypted email are protected, and only the fields that are needed for delivery stay outside.
+				if !strings.Contains(string(content), "Firing") {
+					t.Errorf("mail to %q: got decrypted entity: %q; want plain text", to, content)
+				}
+				for _, want := range []string{"Subject: Disk is full\r\n", "X-Priority: 1 (Highest)\r\n", "In-Reply-To: ", `protected-headers="v1"`} {
+					if !strings.Contains(string(content), want) {
+						t.Errorf("mail to %q: got decrypted entity: %q; want protected header %q", to, content, want)
+					}
+				}
+				for _, field := range []string{"Subject: ...\r\n", "From: ", "Message-ID: "} {
+					if !strings.Contains(string(header), field) {
+						t.Errorf("mail to %q: got header: %q; want header field %q", to, header, field)
+					}
+				}
+				for _, field := range []string{"Disk is full", "X-Priority", "In-Reply-To", "References"} {
+					if strings.Contains(string(header), field) {
+						t.Errorf("mail to %q: got header: %q; want no header field %q", to, header, field)
+					}
+				}
+			}
+		})
+	}
+}
+
+func testSMIMECert(t *testing.T, email string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testVerifySMIME verifies a multipart/signed entity and returns its signed entity.
+func testVerifySMIME(t *testing.T, entity []byte) []byte {
+	m := regexp.MustCompile(`^Content-Type: multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary="(\w+)"\r\n\r\n`).FindSubmatch(entity)
+	if m == nil {
+		t.Fatalf("got entity: %q; want multipart/signed entity", entity)
+	}
+	parts := strings.Split(string(entity[len(m[0]):]), "\r\n--"+string(m[1]))
+	if len(parts) != 3 {
+		t.Fatalf("got entity parts: %q; want signed entity and signature", parts)
+	}
+	signed := strings.TrimPrefix(parts[0], "--"+string(m[1])+"\r\n")
+	p7 := testParsePKCS7(t, parts[1])
+	p7.Content = []byte(signed)
+	if err := p7.Verify(); err != nil {
+		t.Fatalf("got signature error: %v; want valid signature", err)
+	}
+	return []byte(signed)
+}
+
+func testDecryptSMIME(t *testing.T, entity []byte, cert *x509.Certificate, key *rsa.PrivateKey) []byte {
+	if !bytes.HasPrefix(entity, []byte("Content-Type: application/pkcs7-mime; smime-type=enveloped-data")) {
+		t.Fatalf("got entity: %q; want application/pkcs7-mime entity", entity)
+	}
+	content, err := testParsePKCS7(t, string(entity)).Decrypt(cert, key)
+	if err != nil {
+		t.Fatalf("got decryption error: %v; want no error", err)
+	}
+	return content
+}
+
+// testParsePKCS7 parses a PKCS #7 structure from the base64 body of a MIME entity.
+func testParsePKCS7(t *testing.T, entity string) *pkcs7.PKCS7 {
+	body := entity[strings.Index(entity, "\r\n\r\n")+4:]
+	der, err := base64.StdEncoding.DecodeString(strings.Replace(body, "\r\n", "", -1))
+	if err != nil {
+		t.Fatalf("got base64 error: %v; want no error", err)
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		t.Fatalf("got PKCS #7 error: %v; want no error", err)
+	}
+	return p7
+}
+
+func testDecryptPGP(t *testing.T, entity []byte, key *openpgp.Entity) []byte {
+	if !bytes.HasPrefix(entity, []byte(`Content-Type: multipart/encrypted; protocol="application/pgp-encrypted"`)) {
+		t.Fatalf("got entity: %q; want multipart/encrypted entity", entity)
+	}
+	i := bytes.Index(entity, []byte("-----BEGIN PGP MESSAGE-----"))
+	if i == -1 {
+		t.Fatalf("got entity: %q; want OpenPGP message", entity)
+	}
+	block, err := armor.Decode(bytes.NewReader(entity[i:]))
+	if err != nil {
+		t.Fatalf("got armor error: %v; want no error", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{key}, nil, nil)
+	if err != nil {
+		t.Fatalf("got decryption error: %v; want no error", err)
+	}
+	content, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("got decryption error: %v; want no error", err)
+	}
+	return content
+}
+
+func TestSMTPEncryptionNotNeeded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, _ := testSMIMECert(t, "smime@example.org")
+	if err = ioutil.WriteFile(filepath.Join(dir, "smime.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var keyring SMTPKeyring
+	if err = keyring.Decode(dir); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	// Dates, Message-IDs and MIME boundaries differ from email to email, so they are replaced to compare emails.
+	reRandom := regexp.MustCompile(`Date: [^\r]+|<[0-9a-f.]+@example\.org>|[0-9a-f]{60}`)
+	send := func(cnf SMTPConfig) string {
+		cnf.From, cnf.Retries = "notifr@example.org", []time.Duration{0}
+		s := NewSMTPSender(cnf)
+		var got string
+		s.sendfn = func(from string, to []string, data []byte) error {
+			got = string(data)
+			return nil
+		}
+		if err := s.Send([]string{"plain@example.org"}, Message{Subject: "Disk is full", Text: "Firing", Target: "test"}); err != nil {
+			t.Fatalf("got error: %v; want no error", err)
+		}
+		return reRandom.ReplaceAllString(got, "RANDOM")
+	}
+
+	want := send(SMTPConfig{Encrypt: EncryptNever})
+	for _, cnf := range []SMTPConfig{{Encrypt: EncryptAuto}, {Encrypt: EncryptAuto, Keyring: keyring}} {
+		if NewSMTPSender(cnf).needsSecuring("test", []string{"plain@example.org"}) {
+			t.Errorf("got email that needs securing with %q and keyring %q; want plain email", cnf.Encrypt, cnf.Keyring.dir)
+		}
+		if got := send(cnf); got != want {
+			t.Errorf("got mail with %q and keyring %q: %q; want mail: %q", cnf.Encrypt, cnf.Keyring.dir, got, want)
+		}
+	}
+}
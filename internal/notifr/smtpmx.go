@@ -0,0 +1,152 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// newResolver returns a DNS resolver that sends queries to a DNS server with an address.
+// If the address is empty, the function returns the system resolver.
+func newResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// sendMX delivers an email directly to MX servers of the recipients' domains.
+// Recipients are grouped by their domains, and the email is retried for every domain independently,
+// so the returned error lists the domains that the email was not delivered to.
+func (s *SMTPSender) sendMX(to []string, data []byte) error {
+	domains, rcpts := groupByDomain(to)
+	var errs sendErrors
+	for _, domain := range domains {
+		domain := domain
+		err := retry(s.Retries, func() error { return s.deliverMX(domain, rcpts[domain], data) })
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "domain %q", domain))
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// mxTemporaryError is an error of MX delivery that is worth retrying, e.g. a refused connection or a 4xx reply of greylisting.
+// It does not implement Cause, so retry sees it as temporary.
+type mxTemporaryError struct {
+	err error
+}
+
+func (e mxTemporaryError) Error() string   { return e.err.Error() }
+func (e mxTemporaryError) Temporary() bool { return true }
+
+// deliverMX delivers an email to recipients of a domain.
+// MX servers are tried in the order of their preference until one of them accepts the email or rejects it permanently.
+// Unlike an SMTP relay, MX servers reject emails temporarily (4xx) on purpose, so every failure but a 5xx reply is retried.
+func (s *SMTPSender) deliverMX(domain string, to []string, data []byte) error {
+	hosts, err := s.lookupMX(domain)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, host := range hosts {
+		if lastErr = s.deliverToHost(host, to, data); lastErr == nil {
+			return nil
+		}
+		// A permanent rejection (5xx) is the same on every MX server of a domain.
+		if v, ok := lastErr.(*textproto.Error); ok && v.Code >= 500 {
+			return lastErr
+		}
+	}
+	return mxTemporaryError{err: lastErr}
+}
+
+// deliverToHost delivers an email to an MX server.
+func (s *SMTPSender) deliverToHost(host string, to []string, data []byte) error {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig.ServerName = host
+	// Many MX servers have certificates that cannot be verified, so opportunistic TLS encrypts a connection
+	// without authenticating a server (https://tools.ietf.org/html/rfc7435).
+	tlsConfig.InsecureSkipVerify = s.StartTLS != StartTLSMandatory
+
+	c, err := s.connect(host, s.MXPort, false, tlsConfig, nil)
+	if err != nil {
+		return err
+	}
+	if err = sendSMTP(c.Client, s.From, to, data); err != nil {
+		c.Close()
+		return err
+	}
+	c.quit()
+	return nil
+}
+
+// lookupMX returns host names of MX servers of a domain in the order of their preference.
+// A domain without MX records receives emails on its own address (https://tools.ietf.org/html/rfc5321#section-5.1).
+func (s *SMTPSender) lookupMX(domain string) ([]string, error) {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	mxs, err := s.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if v, ok := err.(*net.DNSError); ok && v.IsNotFound {
+			return []string{domain}, nil
+		}
+		return nil, errors.Wrapf(err, "failed to resolve MX records of %q", domain)
+	}
+	// A "null MX" record means that a domain does not accept emails (https://tools.ietf.org/html/rfc7505).
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, fmt.Errorf("domain %q does not accept emails", domain)
+	}
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// groupByDomain groups email addresses by their domains.
+// The domains are returned in the order of their first addresses.
+func groupByDomain(addrs []string) ([]string, map[string][]string) {
+	var (
+		domains []string
+		groups  = make(map[string][]string)
+	)
+	for _, addr := range addrs {
+		domain := strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], addr)
+	}
+	return domains, groups
+}
@@ -0,0 +1,182 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSServer is a fake DNS server that answers MX and A queries from its records.
+type testDNSServer struct {
+	mx map[string][]dnsmessage.MXResource
+	a  map[string][4]byte
+
+	conn net.PacketConn
+}
+
+func (s *testDNSServer) start(t *testing.T) {
+	var err error
+	if s.conn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := s.conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if resp, ok := s.answer(b[:n]); ok {
+				s.conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+}
+
+func (s *testDNSServer) answer(query []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, false
+	}
+	name := strings.ToLower(q.Name.String())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch q.Type {
+	case dnsmessage.TypeMX:
+		for _, mx := range s.mx[name] {
+			b.MXResource(rh, mx)
+		}
+	case dnsmessage.TypeA:
+		if a, ok := s.a[name]; ok {
+			b.AResource(rh, dnsmessage.AResource{A: a})
+		}
+	}
+	resp, err := b.Finish()
+	return resp, err == nil
+}
+
+func (s *testDNSServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testDNSServer) close() {
+	s.conn.Close()
+}
+
+func TestSMTPMX(t *testing.T) {
+	srv := &testSMTPServer{}
+	srv.start(t)
+	defer srv.close()
+
+	// The first MX server of example.org refuses connections because the SMTP server listens only on 127.0.0.1,
+	// so the second one receives emails.
+	dns := &testDNSServer{
+		mx: map[string][]dnsmessage.MXResource{
+			"example.org.": {
+				{Pref: 10, MX: dnsmessage.MustNewName("mx1.example.org.")},
+				{Pref: 20, MX: dnsmessage.MustNewName("mx2.example.org.")},
+			},
+			"null.example.org.": {{Pref: 0, MX: dnsmessage.MustNewName(".")}},
+		},
+		a: map[string][4]byte{
+			"mx1.example.org.":      {127, 0, 0, 2},
+			"mx2.example.org.":      {127, 0, 0, 1},
+			"implicit.example.org.": {127, 0, 0, 1},
+		},
+	}
+	dns.start(t)
+	defer dns.close()
+
+	cnf := SMTPConfig{
+		From:     "notifr@example.com",
+		Retries:  []time.Duration{0},
+		Timeout:  5 * time.Second,
+		MX:       true,
+		MXPort:   srv.port(),
+		Resolver: dns.addr(),
+	}
+	msg := Message{Text: "Test"}
+	err := NewSMTPSender(cnf).Send([]string{"a@example.org", "b@implicit.example.org", "c@Example.org", "d@null.example.org"}, msg)
+	if err == nil || !strings.Contains(err.Error(), `domain "null.example.org": domain "null.example.org" does not accept emails`) {
+		t.Errorf("got error: %v; want error for domain %q", err, "null.example.org")
+	}
+	if err != nil && strings.Contains(err.Error(), `domain "example.org"`) {
+		t.Errorf("got error: %v; want no error for domain %q", err, "example.org")
+	}
+
+	mails := srv.messages()
+	if len(mails) != 2 {
+		t.Fatalf("got mails: %d; want mails: 2", len(mails))
+	}
+	wantTo := [][]string{
+		{"TO:<a@example.org>", "TO:<c@Example.org>"},
+		{"TO:<b@implicit.example.org>"},
+	}
+	for i, want := range wantTo {
+		if !reflect.DeepEqual(mails[i].to, want) {
+			t.Errorf("mail %d: got envelope recipients: %q; want envelope recipients: %q", i, mails[i].to, want)
+		}
+		if !strings.Contains(mails[i].data, "\nTo: a@example.org,b@implicit.example.org,c@Example.org,d@null.example.org\n") {
+			t.Errorf("mail %d: got mail: %q; want header To with all recipients", i, mails[i].data)
+		}
+	}
+}
+
+func TestSMTPMXGreylisting(t *testing.T) {
+	srv := &testSMTPServer{greylist: 1}
+	srv.start(t)
+	defer srv.close()
+
+	dns := &testDNSServer{
+		mx: map[string][]dnsmessage.MXResource{"example.org.": {{Pref: 10, MX: dnsmessage.MustNewName("mx.example.org.")}}},
+		a:  map[string][4]byte{"mx.example.org.": {127, 0, 0, 1}},
+	}
+	dns.start(t)
+	defer dns.close()
+
+	cnf := SMTPConfig{
+		From:     "notifr@example.com",
+		Retries:  []time.Duration{0, 0},
+		Timeout:  5 * time.Second,
+		MX:       true,
+		MXPort:   srv.port(),
+		Resolver: dns.addr(),
+	}
+	s := NewSMTPSender(cnf)
+	if err := s.Send([]string{"a@example.org"}, Message{Text: "Test"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if mails := srv.messages(); len(mails) != 1 || !reflect.DeepEqual(mails[0].to, []string{"TO:<a@example.org>"}) {
+		t.Errorf("got mails: %+v; want a mail to a@example.org after a greylisted attempt", mails)
+	}
+	names := srv.helloNames()
+	if len(names) != 2 {
+		t.Fatalf("got EHLO commands: %d; want EHLO commands: 2", len(names))
+	}
+	for _, name := range names {
+		if name == "localhost" || name != s.helloName() {
+			t.Errorf("got EHLO name: %q; want EHLO name: %q", name, s.helloName())
+		}
+	}
+
+}
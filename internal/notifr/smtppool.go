@@ -0,0 +1,230 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// smtpConn is a connection to an SMTP relay.
+type smtpConn struct {
+	*smtp.Client
+	conn      net.Conn
+	idleSince time.Time
+}
+
+// quit ends an SMTP session and closes a connection.
+func (c *smtpConn) quit() {
+	if err := c.Quit(); err != nil {
+		c.Close()
+	}
+}
+
+// smtpPool is a pool of connections to an SMTP relay.
+// The pool limits a number of open connections and keeps idle connections to reuse them for next emails.
+type smtpPool struct {
+	dial        func() (*smtpConn, error)
+	timeout     time.Duration
+	maxIdle     int
+	idleTimeout time.Duration
+	// sem limits a number of open connections. It is nil if the number is not limited.
+	sem chan struct{}
+
+	mu sync.Mutex
+	// idle are idle connections in the order they were returned to the pool.
+	idle []*smtpConn
+	// reaper closes idle connections when they expire. It is nil when no connection is idle.
+	reaper *time.Timer
+}
+
+func newSMTPPool(cnf SMTPConfig, dial func() (*smtpConn, error)) *smtpPool {
+	p := &smtpPool{
+		dial:        dial,
+		timeout:     cnf.Timeout,
+		maxIdle:     cnf.MaxIdleConns,
+		idleTimeout: cnf.IdleTimeout,
+	}
+	if cnf.MaxConns > 0 {
+		p.sem = make(chan struct{}, cnf.MaxConns)
+	}
+	return p
+}
+
+// smtpPoolTimeoutError is an error that happens when no connection to an SMTP relay becomes free in time.
+// It is temporary, so the email is retried later.
+type smtpPoolTimeoutError struct{}
+
+func (smtpPoolTimeoutError) Error() string {
+	return "timed out waiting for a free connection to the SMTP relay"
+}
+func (smtpPoolTimeoutError) Temporary() bool { return true }
+
+// get returns an idle connection or dials a new one, and reports whether the connection is reused.
+// The caller must return the connection with put or discard.
+// An idle connection is reset before reuse; if the reset fails (e.g. the relay has closed the connection),
+// the connection is closed and the next one is tried.
+// When the number of open connections is limited, get waits for a free connection at most the session timeout.
+func (p *smtpPool) get() (*smtpConn, bool, error) {
+	if err := p.acquire(); err != nil {
+		return nil, false, err
+	}
+	for {
+		c := p.popIdle()
+		if c == nil {
+			break
+		}
+		if err := p.setDeadline(c); err != nil {
+			c.Close()
+			continue
+		}
+		if err := c.Reset(); err != nil {
+			c.Close()
+			continue
+		}
+		return c, true, nil
+	}
+	c, err := p.dial()
+	if err != nil {
+		p.release()
+		return nil, false, err
+	}
+	return c, false, nil
+}
+
+// redial closes a connection that failed and dials a new one in its place.
+// The caller must return the new connection with put or discard.
+func (p *smtpPool) redial(c *smtpConn) (*smtpConn, error) {
+	c.Close()
+	c, err := p.dial()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// popIdle removes the most recently used idle connection from the pool and returns it.
+// Connections that are idle longer than the idle timeout are closed.
+func (p *smtpPool) popIdle() *smtpConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) != 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.idleTimeout > 0 && time.Since(c.idleSince) > p.idleTimeout {
+			c.Close()
+			continue
+		}
+		return c
+	}
+	return nil
+}
+
+// put returns a healthy connection to the pool. The connection is closed if the pool has enough idle connections.
+func (p *smtpPool) put(c *smtpConn) {
+	defer p.release()
+	c.idleSince = time.Now()
+	p.mu.Lock()
+	if len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, c)
+		c = nil
+		if p.idleTimeout > 0 && p.reaper == nil {
+			p.reaper = time.AfterFunc(p.idleTimeout, p.reap)
+		}
+	}
+	p.mu.Unlock()
+	if c != nil {
+		c.quit()
+	}
+}
+
+// reap closes connections that are idle longer than the idle timeout,
+// and schedules itself to the time when the next idle connection expires.
+func (p *smtpPool) reap() {
+	p.mu.Lock()
+	p.reaper = nil
+	n := 0
+	for n < len(p.idle) && time.Since(p.idle[n].idleSince) >= p.idleTimeout {
+		n++
+	}
+	expired := append([]*smtpConn(nil), p.idle[:n]...)
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+	if len(p.idle) != 0 {
+		p.reaper = time.AfterFunc(p.idleTimeout-time.Since(p.idle[0].idleSince), p.reap)
+	}
+	p.mu.Unlock()
+	for _, c := range expired {
+		p.closeIdle(c)
+	}
+}
+
+// discard closes a connection that failed.
+func (p *smtpPool) discard(c *smtpConn) {
+	c.Close()
+	p.release()
+}
+
+// acquire takes a slot of an open connection.
+func (p *smtpPool) acquire() error {
+	if p.sem == nil {
+		return nil
+	}
+	if p.timeout <= 0 {
+		p.sem <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case p.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return smtpPoolTimeoutError{}
+	}
+}
+
+func (p *smtpPool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+// setDeadline sets a deadline of an SMTP session that starts with a connection's reuse.
+func (p *smtpPool) setDeadline(c *smtpConn) error {
+	if p.timeout <= 0 {
+		return nil
+	}
+	return c.conn.SetDeadline(time.Now().Add(p.timeout))
+}
+
+// close closes all idle connections.
+func (p *smtpPool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	if p.reaper != nil {
+		p.reaper.Stop()
+		p.reaper = nil
+	}
+	p.mu.Unlock()
+	for _, c := range idle {
+		p.closeIdle(c)
+	}
+}
+
+// closeIdle ends an SMTP session of an idle connection that has been removed from the pool.
+func (p *smtpPool) closeIdle(c *smtpConn) {
+	if err := p.setDeadline(c); err != nil {
+		c.Close()
+		return
+	}
+	c.quit()
+}
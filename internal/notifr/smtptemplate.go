@@ -0,0 +1,88 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"html/template"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SMTPTemplates is a set of HTML templates of emails.
+// The templates are loaded from files "<name>.html" in a directory, and they can include each other with the action
+// {{template "<name>.html" .}}. A template is a Go html/template that is executed with the fields:
+//
+//	.Subject  - a subject of an email,
+//	.Body     - a message's text that is converted from Markdown to HTML,
+//	.Text     - a message's text in Markdown,
+//	.Target   - a name of a message's target,
+//	.Severity - a message's severity,
+//	.Metadata - a message's metadata.
+//
+// The built-in template "default" is used when a directory does not contain a file "default.html".
+type SMTPTemplates struct {
+	dir  string
+	tmpl *template.Template
+}
+
+// smtpDefaultTemplateText is the built-in HTML template of emails.
+// The style allows to correctly display the tables in the received emails, otherwise, without using CSS, the table frames are not displayed.
+const smtpDefaultTemplateText = `
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:o="urn:schemas-microsoft-com:office:office">
+	<head>
+		<title>{{.Subject}}</title><style>table,th,td{border: 1px solid black;} tr:nth-child(even){background-color: grey;}</style></head>
+	<body>{{.Body}}</body>
+</html>
+`
+
+var smtpDefaultTemplate = template.Must(template.New("default.html").Parse(smtpDefaultTemplateText))
+
+// Decode loads HTML templates of emails from a directory.
+func (t *SMTPTemplates) Decode(value string) error {
+	if value == "" {
+		return nil
+	}
+	// The built-in template is parsed again because an executed template cannot be cloned.
+	tmpl := template.Must(template.New("default.html").Parse(smtpDefaultTemplateText))
+	tmpl, err := tmpl.ParseGlob(filepath.Join(value, "*.html"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to load email templates from %q", value)
+	}
+	t.dir, t.tmpl = value, tmpl
+	return nil
+}
+
+// MarshalJSON serializes SMTPTemplates to the path of the templates' directory.
+func (t SMTPTemplates) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.dir)
+}
+
+// Has returns true if a template with the name exists.
+func (t SMTPTemplates) Has(name string) bool {
+	return t.lookup(name) != nil
+}
+
+// lookup returns a template with the name or nil if the template does not exist.
+func (t SMTPTemplates) lookup(name string) *template.Template {
+	if t.tmpl == nil {
+		return smtpDefaultTemplate.Lookup(name + ".html")
+	}
+	return t.tmpl.Lookup(name + ".html")
+}
+
+// smtpTemplateData is data of an HTML template of an email.
+type smtpTemplateData struct {
+	Message
+	// Subject is a subject of an email that is filled even if a message has no subject.
+	Subject string
+	// Body is a message's text that is converted from Markdown to HTML.
+	Body template.HTML
+}
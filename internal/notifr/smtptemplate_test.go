@@ -0,0 +1,88 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSMTPTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"brand.html":  `<h1>{{.Subject}}</h1>{{.Body}}{{template "footer.html" .}}`,
+		"footer.html": `<p>{{.Target}}: <a href="{{.Metadata.dashboard}}">dashboard</a></p>`,
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var templates SMTPTemplates
+	if err = templates.Decode(dir); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	testCases := []struct {
+		name    string
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "default template",
+			target: "ops",
+			want:   "<title>Alert &lt;db&gt;</title>",
+		},
+		{
+			name:   "target's template",
+			target: "customers",
+			want:   `<h1>Alert &lt;db&gt;</h1><p><strong>Down</strong></p>` + "\n" + `<p>customers: <a href="https://grafana.example.org/d/1">dashboard</a></p>`,
+		},
+		{
+			name:    "unknown template",
+			target:  "unknown",
+			wantErr: true,
+		},
+	}
+	cnf := SMTPConfig{
+		Templates:       templates,
+		Template:        "default",
+		TargetTemplates: map[string]string{"customers": "brand", "unknown": "none"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := Message{
+				Subject:  "Alert <db>",
+				Text:     "**Down**",
+				Target:   tc.target,
+				Metadata: map[string]string{"dashboard": "https://grafana.example.org/d/1"},
+			}
+			got, err := NewSMTPSender(cnf).renderHTML(msg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if !strings.Contains(got, tc.want) {
+				t.Errorf("got HTML: %q; want HTML that contains: %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SyslogConfig is configuration for syslog.
+type SyslogConfig struct {
+	Facility SyslogFacility  `envconfig:"facility" default:"local0" desc:"a syslog facility of records (kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp, local0-local7)"`
+	AppName  string          `envconfig:"app_name" default:"notifr" desc:"an application name of records"`
+	Hostname string          `envconfig:"hostname" desc:"a hostname of records; the name of the host is used when it is empty"`
+	Timeout  time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of a connection to a syslog server"`
+	Retries  []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// SyslogFacility is a syslog facility (https://tools.ietf.org/html/rfc5424#section-6.2.1).
+type SyslogFacility int
+
+// syslogFacilities are codes of syslog facilities by their names.
+var syslogFacilities = map[string]SyslogFacility{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Decode decodes a syslog facility from its name.
+func (f *SyslogFacility) Decode(value string) error {
+	v, ok := syslogFacilities[strings.ToLower(value)]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %q", value)
+	}
+	*f = v
+	return nil
+}
+
+// SyslogSender is a message sender that writes a message as a syslog record in the RFC 5424 format.
+// Recipients of the delivery are addresses of syslog servers: udp://host:port, tcp://host:port or unix:///path.
+type SyslogSender struct {
+	SyslogConfig
+}
+
+// NewSyslogSender returns a new SyslogSender.
+func NewSyslogSender(cnf SyslogConfig) *SyslogSender {
+	if cnf.Hostname == "" {
+		cnf.Hostname, _ = os.Hostname()
+	}
+	return &SyslogSender{SyslogConfig: cnf}
+}
+
+// syslogSDID is an ID of the structured data element of records.
+// The enterprise number 32473 is reserved for documentation (https://tools.ietf.org/html/rfc5612).
+const syslogSDID = "notifr@32473"
+
+// syslogSeverities are syslog severities for severities of messages.
+// A message without a known severity is written with the severity "notice".
+var syslogSeverities = map[string]int{
+	"critical": 2,
+	"error":    3,
+	"warning":  4,
+	"info":     6,
+	"ok":       5,
+	"resolved": 5,
+}
+
+const syslogSeverityNotice = 5
+
+// syslogDefaultPort is a port of a syslog server when an address does not contain it.
+const syslogDefaultPort = "514"
+
+// Send writes a message to syslog servers.
+// A record contains the message's target, delivery and severity as structured data,
+// and its text is the message's subject and the message's text flattened to plain text.
+func (s *SyslogSender) Send(recipients []string, msg Message) error {
+	record := s.newRecord(msg, time.Now())
+	return sendEach(recipients, msg, func(rcpt string) error {
+		network, addr, err := parseSyslogAddr(rcpt)
+		if err != nil {
+			return err
+		}
+		return retry(s.Retries, func() error { return s.write(network, addr, record) })
+	})
+}
+
+// write sends a record to a syslog server.
+// Records are framed with octet counting in TCP streams (https://tools.ietf.org/html/rfc6587#section-3.4.1),
+// and they are sent as is in datagrams.
+func (s *SyslogSender) write(network, addr, record string) error {
+	conn, err := net.DialTimeout(network, addr, s.Timeout)
+	if err != nil && network == "unixgram" {
+		// A unix socket may be a stream socket.
+		network = "unix"
+		conn, err = net.DialTimeout(network, addr, s.Timeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if s.Timeout > 0 {
+		if err = conn.SetWriteDeadline(time.Now().Add(s.Timeout)); err != nil {
+			return err
+		}
+	}
+	switch network {
+	case "tcp":
+		record = strconv.Itoa(len(record)) + " " + record
+	case "unix":
+		record += "\n"
+	}
+	_, err = conn.Write([]byte(record))
+	return err
+}
+
+// newRecord formats a message as a syslog record (https://tools.ietf.org/html/rfc5424#section-6).
+func (s *SyslogSender) newRecord(msg Message, ts time.Time) string {
+	severity, ok := syslogSeverities[strings.ToLower(msg.Severity)]
+	if !ok {
+		severity = syslogSeverityNotice
+	}
+	sd := fmt.Sprintf(`[%s target="%s" delivery="%s"`, syslogSDID, syslogParamEscaper.Replace(msg.Target), DeliverySyslog)
+	if msg.Severity != "" {
+		sd += fmt.Sprintf(` severity="%s"`, syslogParamEscaper.Replace(msg.Severity))
+	}
+	sd += "]"
+
+	text := plainTextRenderer.render(msg.Text)
+	if msg.Subject != "" {
+		text = strings.TrimSpace(msg.Subject + "\n" + text)
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d - %s \ufeff%s",
+		int(s.Facility)*8+severity,
+		ts.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(s.Hostname, 255),
+		syslogHeaderField(s.AppName, 48),
+		os.Getpid(),
+		sd,
+		text,
+	)
+}
+
+// syslogParamEscaper escapes characters of a value of a structured data parameter.
+var syslogParamEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "]", `\]`)
+
+// syslogHeaderField returns a value of a header field of a syslog record.
+// Header fields may contain only printable ASCII characters, and an empty field is replaced with the nil value "-".
+func syslogHeaderField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return s
+}
+
+// parseSyslogAddr parses an address of a syslog server and returns a network and an address to dial.
+func parseSyslogAddr(rcpt string) (network, addr string, err error) {
+	u, err := url.Parse(rcpt)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Hostname() == "" {
+			return "", "", errors.New("syslog address without a host")
+		}
+		port := u.Port()
+		if port == "" {
+			port = syslogDefaultPort
+		}
+		return u.Scheme, net.JoinHostPort(u.Hostname(), port), nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", errors.New("syslog address without a path")
+		}
+		return "unixgram", u.Path, nil
+	}
+	return "", "", fmt.Errorf("unsupported syslog network %q", u.Scheme)
+}
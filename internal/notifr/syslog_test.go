@@ -0,0 +1,121 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogRecord(t *testing.T) {
+	sender := NewSyslogSender(SyslogConfig{Facility: 16, AppName: "notifr", Hostname: "host 1"})
+	msg := Message{Subject: "Alert", Text: "**Disk** is full", Severity: "critical", Target: `ops"1`}
+	ts := time.Date(2019, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	got := sender.newRecord(msg, ts)
+	want := fmt.Sprintf("<130>1 2019-10-01T12:30:00.000000Z host1 notifr %d - "+
+		`[notifr@32473 target="ops\"1" delivery="syslog" severity="critical"] `+"\ufeffAlert\nDisk is full", os.Getpid())
+	if got != want {
+		t.Errorf("got record: %q; want record: %q", got, want)
+	}
+}
+
+func TestParseSyslogAddr(t *testing.T) {
+	testCases := []struct {
+		rcpt        string
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{rcpt: "udp://logs.example.org", wantNetwork: "udp", wantAddr: "logs.example.org:514"},
+		{rcpt: "tcp://logs.example.org:601", wantNetwork: "tcp", wantAddr: "logs.example.org:601"},
+		{rcpt: "unix:///dev/log", wantNetwork: "unixgram", wantAddr: "/dev/log"},
+		{rcpt: "tcp:///dev/log", wantErr: true},
+		{rcpt: "unix://", wantErr: true},
+		{rcpt: "logs.example.org:514", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.rcpt, func(t *testing.T) {
+			network, addr, err := parseSyslogAddr(tc.rcpt)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if network != tc.wantNetwork || addr != tc.wantAddr {
+				t.Errorf("got address: %s %s; want address: %s %s", network, addr, tc.wantNetwork, tc.wantAddr)
+			}
+		})
+	}
+}
+
+func TestSyslogSender(t *testing.T) {
+	sender := NewSyslogSender(SyslogConfig{AppName: "notifr", Hostname: "host", Timeout: time.Second, Retries: []time.Duration{0}})
+	msg := Message{Text: "Test", Target: "ops"}
+	// Records are compared by length because they contain the time of sending.
+	wantLen := len(sender.newRecord(msg, time.Now()))
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if err = sender.Send([]string{"udp://" + conn.LocalAddr().String()}, msg); err != nil {
+			t.Fatalf("got error: %v; want no error", err)
+		}
+		buf := make([]byte, 2048)
+		if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != wantLen {
+			t.Errorf("got record: %q; want record of length %d", buf[:n], wantLen)
+		}
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		got := make(chan string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				got <- err.Error()
+				return
+			}
+			defer conn.Close()
+			b, _ := ioutil.ReadAll(conn)
+			got <- string(b)
+		}()
+
+		if err = sender.Send([]string{"tcp://" + ln.Addr().String()}, msg); err != nil {
+			t.Fatalf("got error: %v; want no error", err)
+		}
+		prefix := fmt.Sprintf("%d <5>1 ", wantLen)
+		if v := <-got; !strings.HasPrefix(v, prefix) || len(v) != len(prefix)+wantLen-len("<5>1 ") {
+			t.Errorf("got record: %q; want record of length %d with prefix %q", v, wantLen, prefix)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+// TeamsConfig is configuration for Microsoft Teams webhooks.
+type TeamsConfig struct {
+	Timeout time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Microsoft Teams"`
+	Retries []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// TeamsSender is a message sender that sends a message as an Adaptive Card to Microsoft Teams webhooks.
+// Recipients of the delivery are URLs of Workflows webhooks or Office 365 connectors.
+type TeamsSender struct {
+	TeamsConfig
+	client *http.Client
+}
+
+// NewTeamsSender returns a new TeamsSender.
+func NewTeamsSender(cnf TeamsConfig) *TeamsSender {
+	return &TeamsSender{
+		TeamsConfig: cnf,
+		client:      &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// teamsMessage is a message with an Adaptive Card attachment (https://adaptivecards.io/explorer/AdaptiveCard.html).
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string          `json:"$schema"`
+	Type    string          `json:"type"`
+	Version string          `json:"version"`
+	Body    []teamsCardItem `json:"body"`
+	MSTeams struct {
+		Width string `json:"width"`
+	} `json:"msteams"`
+}
+
+// teamsCardItem is a card element TextBlock (https://adaptivecards.io/explorer/TextBlock.html).
+type teamsCardItem struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	Wrap     bool   `json:"wrap"`
+	Size     string `json:"size,omitempty"`
+	Weight   string `json:"weight,omitempty"`
+	FontType string `json:"fontType,omitempty"`
+}
+
+// Send sends a message to Microsoft Teams webhooks.
+// The method tries to re-send a message when the previous sending failed with a temporary error.
+func (s *TeamsSender) Send(recipients []string, msg Message) error {
+	payload := newTeamsMessage(msg)
+	return sendEach(recipients, msg, func(url string) error {
+		return retry(s.Retries, func() error { return hideURL(postJSON(s.client, url, payload, nil)) })
+	})
+}
+
+// newTeamsMessage converts a message to an Adaptive Card.
+// The card's title is a message's subject or the first line of a message's text.
+// Every top-level Markdown block of a message's text becomes a separate text block of the card.
+func newTeamsMessage(msg Message) *teamsMessage {
+	card := teamsCard{
+		Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+		Type:    "AdaptiveCard",
+		Version: "1.4",
+		Body: []teamsCardItem{
+			{Type: "TextBlock", Text: messageTitle(msg), Wrap: true, Size: "Large", Weight: "Bolder"},
+		},
+	}
+	card.MSTeams.Width = "Full"
+	doc := parseMarkdown(msg.Text)
+	for node := doc.FirstChild; node != nil; node = node.Next {
+		item := teamsCardItem{Type: "TextBlock", Wrap: true}
+		switch node.Type {
+		case blackfriday.Heading:
+			item.Text, item.Weight = teamsRenderer.inlines(node), "Bolder"
+			if node.Level <= 2 {
+				item.Size = "Medium"
+			}
+		case blackfriday.CodeBlock:
+			item.Text, item.FontType = strings.TrimRight(string(node.Literal), "\n"), "Monospace"
+		default:
+			item.Text = teamsRenderer.block(node)
+		}
+		if strings.TrimSpace(item.Text) != "" {
+			card.Body = append(card.Body, item)
+		}
+	}
+	return &teamsMessage{
+		Type:        "message",
+		Attachments: []teamsAttachment{{ContentType: "application/vnd.microsoft.card.adaptive", Content: card}},
+	}
+}
+
+// teamsRenderer renders Markdown to the Markdown subset that Adaptive Cards support
+// (https://learn.microsoft.com/en-us/adaptive-cards/authoring-cards/text-features).
+// Adaptive Cards do not support code, strikethrough and quotes, so these elements are rendered as a plain text.
+var teamsRenderer = &textRenderer{
+	escape:    func(s string) string { return s },
+	emph:      [2]string{"_", "_"},
+	strong:    [2]string{"**", "**"},
+	code:      func(code string) string { return code },
+	codeBlock: func(lang, code string) string { return code },
+	link: func(dest, text string) string {
+		if text == "" {
+			text = dest
+		}
+		return "[" + text + "](" + dest + ")"
+	},
+	quote:  func(blocks []string) string { return strings.Join(blocks, "\n\n") },
+	hr:     "---",
+	bullet: "- ",
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewTeamsMessage(t *testing.T) {
+	testCases := []struct {
+		name string
+		msg  Message
+		want []teamsCardItem
+	}{
+		{
+			name: "with subject",
+			msg:  Message{Subject: "Alert", Text: "**Disk** is ~~almost~~ full\n\n- db1\n- [db2](https://db2.example.org)"},
+			want: []teamsCardItem{
+				{Type: "TextBlock", Text: "Alert", Wrap: true, Size: "Large", Weight: "Bolder"},
+				{Type: "TextBlock", Text: "**Disk** is almost full", Wrap: true},
+				{Type: "TextBlock", Text: "- db1\n- [db2](https://db2.example.org)", Wrap: true},
+			},
+		},
+		{
+			name: "without subject",
+			msg:  Message{Text: "# Disk is full\n\n```\ndf -h\n```"},
+			want: []teamsCardItem{
+				{Type: "TextBlock", Text: "Disk is full", Wrap: true, Size: "Large", Weight: "Bolder"},
+				{Type: "TextBlock", Text: "Disk is full", Wrap: true, Size: "Medium", Weight: "Bolder"},
+				{Type: "TextBlock", Text: "df -h", Wrap: true, FontType: "Monospace"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := newTeamsMessage(tc.msg)
+			if len(got.Attachments) != 1 {
+				t.Fatalf("got %d attachments; want 1 attachment", len(got.Attachments))
+			}
+			if body := got.Attachments[0].Content.Body; !reflect.DeepEqual(body, tc.want) {
+				t.Errorf("got card body: %+v; want card body: %+v", body, tc.want)
+			}
+		})
+	}
+}
+
+func TestTeamsSender(t *testing.T) {
+	var (
+		cnt int
+		got map[string]interface{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cnt++
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode payload: %s", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	sender := NewTeamsSender(TeamsConfig{Retries: []time.Duration{0}})
+	if err := sender.Send([]string{srv.URL, srv.URL}, Message{Text: "Test"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if cnt != 2 {
+		t.Errorf("got requests: %d; want requests: 2", cnt)
+	}
+	if got["type"] != "message" {
+		t.Errorf("got message type: %v; want message type: message", got["type"])
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	strip "github.com/grokify/html-strip-tags-go"
+)
+
+// TelegramConfig is configuration for Telegram Bot API.
+type TelegramConfig struct {
+	Token   string          `envconfig:"token" json:"-" desc:"a token of a Telegram bot; the delivery is disabled when the token is empty"`
+	APIURL  string          `envconfig:"api_url" default:"https://api.telegram.org" desc:"a base URL of Telegram Bot API"`
+	Timeout time.Duration   `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to Telegram"`
+	Retries []time.Duration `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// TelegramSender is a message sender that sends a message by Telegram Bot API.
+// Recipients of the delivery are chat IDs or channel usernames (@channel).
+type TelegramSender struct {
+	TelegramConfig
+	client *http.Client
+}
+
+// NewTelegramSender returns a new TelegramSender.
+func NewTelegramSender(cnf TelegramConfig) *TelegramSender {
+	return &TelegramSender{
+		TelegramConfig: cnf,
+		client:         &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// telegramMessageMaxLen is a maximum length of a message text in Telegram (https://core.telegram.org/bots/api#sendmessage).
+const telegramMessageMaxLen = 4096
+
+// telegramMessage is a request of the method "sendMessage" of Telegram Bot API.
+type telegramMessage struct {
+	ChatID                string `json:"chat_id"`
+	Text                  string `json:"text"`
+	ParseMode             string `json:"parse_mode"`
+	DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+}
+
+// Send sends a message to Telegram chats.
+// A message that exceeds the Telegram's limit is sent as several consecutive messages.
+// The method tries to re-send a message when the previous sending failed with a temporary error.
+func (s *TelegramSender) Send(recipients []string, msg Message) error {
+	chunks := telegramChunks(msg)
+	endpoint := strings.TrimRight(s.APIURL, "/") + "/bot" + s.Token + "/sendMessage"
+	return sendEach(recipients, msg, func(chatID string) error {
+		for _, chunk := range chunks {
+			tm := &telegramMessage{ChatID: chatID, Text: chunk, ParseMode: "HTML", DisableWebPagePreview: true}
+			// An error of an HTTP client contains the request's URL, so we hide it to not leak the bot's token to logs.
+			err := retry(s.Retries, func() error { return hideURL(postJSON(s.client, endpoint, tm, nil)) })
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// telegramChunks converts a message to Telegram HTML and splits it into chunks that fit the Telegram's limit.
+func telegramChunks(msg Message) []string {
+	var blocks []string
+	if msg.Subject != "" {
+		blocks = append(blocks, "<b>"+telegramEscaper.Replace(msg.Subject)+"</b>")
+	}
+	blocks = append(blocks, telegramRenderer.renderBlocks(msg.Text)...)
+	return joinChunks(blocks, "\n\n", telegramMessageMaxLen, func(block string) []string {
+		// A block cannot be split without breaking HTML tags, so a too long block is sent without formatting.
+		var chunks []string
+		for _, chunk := range splitText(html.UnescapeString(strip.StripTags(block)), telegramMessageMaxLen) {
+			chunks = append(chunks, telegramEscaper.Replace(chunk))
+		}
+		return chunks
+	})
+}
+
+// telegramEscaper escapes characters that Telegram requires to escape in HTML (https://core.telegram.org/bots/api#html-style).
+var telegramEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// telegramRenderer renders Markdown to the subset of HTML that Telegram supports.
+var telegramRenderer = &textRenderer{
+	escape: telegramEscaper.Replace,
+	emph:   [2]string{"<i>", "</i>"},
+	strong: [2]string{"<b>", "</b>"},
+	del:    [2]string{"<s>", "</s>"},
+	code:   func(code string) string { return "<code>" + telegramEscaper.Replace(code) + "</code>" },
+	codeBlock: func(lang, code string) string {
+		code = telegramEscaper.Replace(code)
+		if lang == "" {
+			return "<pre>" + code + "</pre>"
+		}
+		return `<pre><code class="language-` + telegramEscaper.Replace(lang) + `">` + code + "</code></pre>"
+	},
+	link: func(dest, text string) string {
+		if text == "" {
+			text = telegramEscaper.Replace(dest)
+		}
+		return `<a href="` + telegramEscaper.Replace(dest) + `">` + text + "</a>"
+	},
+	quote:  func(blocks []string) string { return "<blockquote>" + strings.Join(blocks, "\n\n") + "</blockquote>" },
+	hr:     "———",
+	bullet: "• ",
+}
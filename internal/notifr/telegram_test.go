@@ -0,0 +1,100 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelegramChunks(t *testing.T) {
+	longLine := strings.Repeat("a", 3000)
+	testCases := []struct {
+		name string
+		msg  Message
+		want []string
+	}{
+		{
+			name: "formatting",
+			msg:  Message{Subject: "Alert <1>", Text: "# Disk\n\n**full** on _db1_, see [graph](https://example.org/?a=1&b=2)"},
+			want: []string{`<b>Alert &lt;1&gt;</b>
+
+<b>Disk</b>
+
+<b>full</b> on <i>db1</i>, see <a href="https://example.org/?a=1&amp;b=2">graph</a>`},
+		},
+		{
+			name: "code",
+			msg:  Message{Text: "```go\nif a < b {}\n```"},
+			want: []string{`<pre><code class="language-go">if a &lt; b {}</code></pre>`},
+		},
+		{
+			name: "list",
+			msg:  Message{Text: "- one\n- two"},
+			want: []string{"• one\n• two"},
+		},
+		{
+			name: "split by blocks",
+			msg:  Message{Text: longLine + "\n\n" + longLine},
+			want: []string{longLine, longLine},
+		},
+		{
+			name: "split a long block",
+			msg:  Message{Text: "**" + strings.Repeat("b", 5000) + "**"},
+			want: []string{strings.Repeat("b", 4096), strings.Repeat("b", 904)},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := telegramChunks(tc.msg); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got chunks: %q; want chunks: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTelegramSender(t *testing.T) {
+	var got []telegramMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottest-token/sendMessage" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var tm telegramMessage
+		if err := json.NewDecoder(r.Body).Decode(&tm); err != nil {
+			t.Errorf("failed to decode payload: %s", err)
+		}
+		if tm.ChatID == "@forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot is not a member of the channel chat"}`))
+			return
+		}
+		got = append(got, tm)
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer srv.Close()
+
+	sender := NewTelegramSender(TelegramConfig{Token: "test-token", APIURL: srv.URL, Retries: []time.Duration{0}})
+
+	err := sender.Send([]string{"-100123", "@forbidden", "42"}, Message{Text: "Test"})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got error: %v; want an error with status 403", err)
+	}
+	want := []telegramMessage{
+		{ChatID: "-100123", Text: "Test", ParseMode: "HTML", DisableWebPagePreview: true},
+		{ChatID: "42", Text: "Test", ParseMode: "HTML", DisableWebPagePreview: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages: %+v; want messages: %+v", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+// WebhookConfig is configuration for outgoing HTTP webhooks.
+type WebhookConfig struct {
+	Endpoints WebhookEndpoints `envconfig:"endpoints" desc:"a path to a JSON file that describes webhook endpoints; the delivery is disabled when the path is empty"`
+	Timeout   time.Duration    `envconfig:"timeout" default:"10s" desc:"a timeout of an HTTP request to a webhook"`
+	Retries   []time.Duration  `envconfig:"retries" default:"10s,1m,10m" desc:"intervals to retry message sending"`
+}
+
+// WebhookEndpoints is a set of named webhook endpoints.
+// The endpoints are loaded from a JSON file in the format:
+//
+//	{
+//	  "jira": {
+//	    "url": "https://jira.example.org/rest/api/2/issue",
+//	    "method": "POST",
+//	    "headers": {"Authorization": "Basic dXNlcjpwYXNz"},
+//	    "content_type": "application/json",
+//	    "body": "{\"fields\": {\"summary\": {{json .Subject}}, \"description\": {{json .Text}}}}"
+//	  }
+//	}
+//
+// A body is a Go text/template that is executed with a message. It is sent with the content type "application/json"
+// unless the endpoint sets another one.
+// The template can use the functions "json" that encodes a value to JSON, and "html" that converts Markdown to HTML.
+type WebhookEndpoints struct {
+	path      string
+	endpoints map[string]*webhookEndpoint
+}
+
+// webhookEndpoint is an HTTP endpoint that receives messages.
+type webhookEndpoint struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	Headers     map[string]string `json:"headers"`
+	ContentType string            `json:"content_type"`
+	Body        string            `json:"body"`
+	body        *template.Template
+}
+
+// webhookFuncs are functions that are available in templates of webhook bodies.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+	},
+	"html": func(s string) string {
+		return string(blackfriday.Run([]byte(s)))
+	},
+}
+
+// Decode loads webhook endpoints from a JSON file.
+func (e *WebhookEndpoints) Decode(value string) error {
+	if value == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(value)
+	if err != nil {
+		return err
+	}
+	var endpoints map[string]*webhookEndpoint
+	if err = json.Unmarshal(b, &endpoints); err != nil {
+		return errors.Wrapf(err, "failed to parse webhook endpoints %q", value)
+	}
+	for name, ep := range endpoints {
+		if ep == nil || !isHTTPURL(ep.URL) {
+			return fmt.Errorf("webhook endpoint %q: invalid URL", name)
+		}
+		if ep.Method == "" {
+			ep.Method = http.MethodPost
+		}
+		ep.Method = strings.ToUpper(ep.Method)
+		if ep.ContentType == "" {
+			ep.ContentType = "application/json"
+		}
+		if ep.body, err = template.New(name).Funcs(webhookFuncs).Parse(ep.Body); err != nil {
+			return errors.Wrapf(err, "webhook endpoint %q: invalid body template", name)
+		}
+	}
+	e.path, e.endpoints = value, endpoints
+	return nil
+}
+
+// MarshalJSON serializes WebhookEndpoints to the path of the endpoints' file.
+// Endpoints are not serialized because their headers can contain credentials.
+func (e WebhookEndpoints) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.path)
+}
+
+// Empty returns true if no endpoints are configured.
+func (e WebhookEndpoints) Empty() bool {
+	return len(e.endpoints) == 0
+}
+
+// WebhookSender is a message sender that sends a message to HTTP webhooks.
+// Recipients of the delivery are names of webhook endpoints.
+type WebhookSender struct {
+	WebhookConfig
+	client *http.Client
+}
+
+// NewWebhookSender returns a new WebhookSender.
+func NewWebhookSender(cnf WebhookConfig) *WebhookSender {
+	return &WebhookSender{
+		WebhookConfig: cnf,
+		client:        &http.Client{Timeout: cnf.Timeout},
+	}
+}
+
+// hasRecipient returns true if a webhook endpoint with the name is configured.
+func (s *WebhookSender) hasRecipient(name string) bool {
+	_, ok := s.Endpoints.endpoints[name]
+	return ok
+}
+
+// Send sends a message to webhook endpoints.
+// The method tries to re-send a message when the previous sending failed with a temporary error.
+func (s *WebhookSender) Send(recipients []string, msg Message) error {
+	return sendEach(recipients, msg, func(name string) error {
+		ep, ok := s.Endpoints.endpoints[name]
+		if !ok {
+			return errors.New("unknown webhook endpoint")
+		}
+		var body bytes.Buffer
+		if err := ep.body.Execute(&body, msg); err != nil {
+			return errors.Wrap(err, "failed to render body")
+		}
+		// An endpoint's URL can contain a token, so it is hidden in errors to not leak to logs.
+		return retry(s.Retries, func() error {
+			req, err := http.NewRequest(ep.Method, ep.URL, bytes.NewReader(body.Bytes()))
+			if err != nil {
+				return hideURL(err)
+			}
+			if body.Len() != 0 {
+				req.Header.Set("Content-Type", ep.ContentType)
+			}
+			for k, v := range ep.Headers {
+				req.Header.Set(k, v)
+			}
+			return hideURL(doHTTP(s.client, req, nil))
+		})
+	})
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) JSC iCore.
+
+This source code is licensed under the MIT license found in the
+LICENSE file in the root directory of this source tree.
+*/
+
+package notifr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookEndpointsDecode(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "invalid JSON",
+			content: `{"jira":`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid URL",
+			content: `{"jira": {"url": "jira.example.org"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid template",
+			content: `{"jira": {"url": "https://jira.example.org", "body": "{{.Subject"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "all ok",
+			content: `{"jira": {"url": "https://jira.example.org", "body": "{{json .Subject}}"}}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := testWriteFile(t, tc.content)
+			defer os.Remove(path)
+
+			var endpoints WebhookEndpoints
+			err := endpoints.Decode(path)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v; want no error", err)
+			}
+			if ep := endpoints.endpoints["jira"]; ep == nil || ep.Method != http.MethodPost {
+				t.Errorf("got endpoint: %+v; want endpoint with method POST", ep)
+			}
+		})
+	}
+}
+
+func TestWebhookSender(t *testing.T) {
+	var (
+		cnt        int
+		gotMethod  string
+		gotBody    string
+		gotHeaders http.Header
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cnt++
+		if cnt == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		gotMethod, gotBody, gotHeaders = r.Method, string(b), r.Header
+	}))
+	defer srv.Close()
+
+	path := testWriteFile(t, `{
+		"tickets": {
+			"url": "`+srv.URL+`",
+			"method": "put",
+			"headers": {"Authorization": "Bearer token"},
+			"body": "{\"title\": {{json .Subject}}, \"html\": {{html .Text | json}}}"
+		}
+	}`)
+	defer os.Remove(path)
+
+	cnf := WebhookConfig{Retries: []time.Duration{0, 0}}
+	if err := cnf.Endpoints.Decode(path); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	sender := NewWebhookSender(cnf)
+	if err := sender.Send([]string{"tickets"}, Message{Subject: `Disk "db1"`, Text: "**full**"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+
+	if cnt != 2 {
+		t.Errorf("got retries: %d; want retries: 2", cnt)
+	}
+	if gotMethod != http.MethodPut {
+		t.Errorf("got method: %s; want method: %s", gotMethod, http.MethodPut)
+	}
+	if v := gotHeaders.Get("Authorization"); v != "Bearer token" {
+		t.Errorf("got header Authorization: %q; want header Authorization: %q", v, "Bearer token")
+	}
+	if v := gotHeaders.Get("Content-Type"); v != "application/json" {
+		t.Errorf("got header Content-Type: %q; want header Content-Type: %q", v, "application/json")
+	}
+	wantBody := `{"title": "Disk \"db1\"", "html": "<p><strong>full</strong></p>\n"}`
+	if gotBody != wantBody {
+		t.Errorf("got body: %s; want body: %s", gotBody, wantBody)
+	}
+
+	if err := sender.Send([]string{"unknown"}, Message{Text: "Test"}); err == nil {
+		t.Error("got no error for an unknown endpoint; want error")
+	}
+}
+
+func TestWebhookSenderContentType(t *testing.T) {
+	var gotContentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotContentType = r.Header.Get("Content-Type")
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	path := testWriteFile(t, `{
+		"form": {"url": "`+srv.URL+`", "content_type": "application/x-www-form-urlencoded", "body": "text={{.Text | urlquery}}"},
+		"closed": {"url": "`+closed.URL+`/hooks/secret-token", "body": "{}"}
+	}`)
+	defer os.Remove(path)
+
+	cnf := WebhookConfig{Retries: []time.Duration{0}}
+	if err := cnf.Endpoints.Decode(path); err != nil {
+		t.Fatalf("unexpected decode error: %s", err)
+	}
+	sender := NewWebhookSender(cnf)
+	if err := sender.Send([]string{"form"}, Message{Text: "Test"}); err != nil {
+		t.Fatalf("got error: %v; want no error", err)
+	}
+	if gotContentType != "application/x-www-form-urlencoded" {
+		t.Errorf("got header Content-Type: %q; want header Content-Type: %q", gotContentType, "application/x-www-form-urlencoded")
+	}
+
+	err := sender.Send([]string{"closed"}, Message{Text: "Test"})
+	if err == nil {
+		t.Fatal("got no error; want error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("got error: %v; want error without the endpoint's URL", err)
+	}
+}
+
+func testWriteFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "notifr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}